@@ -4,42 +4,73 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"log"
-	"strconv"
-
-	"github.com/docker/docker/api/types/filters"
-	"google.golang.org/grpc"
+	"sort"
+	"strings"
 
 	"github.com/buger/jsonparser"
 	dockerTypes "github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	docker "github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
 	consul "github.com/hashicorp/consul/api"
 	pb "github.com/opencopilot/agent/agent"
-	managerPb "github.com/opencopilot/agent/manager"
 	"github.com/opencopilot/consulkvjson"
-	"gopkg.in/yaml.v2"
 )
 
+// managerGRPCPort is the port managers serve gRPC on inside their container
+const managerGRPCPort = 50052
+
 // Service is a specification for a service running on the device
 type Service string
 
 // Services is a list of Service
 type Services []Service
 
+func (services Services) contains(service Service) bool {
+	for _, s := range services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
 // Agent handles agent functionality
 type Agent struct {
-	dockerCli *docker.Client
-	consulCli *consul.Client
+	runtime     ContainerRuntime
+	provider    ServiceProvider
+	configStore ConfigStore
+	managers    *ManagerPool
+	firewall    Firewall
+	registry    ServiceRegistry
+	status      *StatusReporter
+	maintenance *Maintenance
+	snapshot    *ConfigSnapshot
 }
 
 // AgentGetStatus returns the status of a running service
 func (agent *Agent) AgentGetStatus(ctx context.Context) (*pb.AgentStatus, error) {
 
-	status := &pb.AgentStatus{InstanceId: InstanceID, Services: []*pb.AgentStatus_AgentService{}}
+	maintenance := agent.maintenance.State()
+	status := &pb.AgentStatus{
+		InstanceId:           InstanceID,
+		Services:             []*pb.AgentStatus_AgentService{},
+		ReconciliationPaused: maintenance.Paused,
+		PauseReason:          maintenance.Reason,
+	}
+
+	if agent.runtime == nil {
+		// Without docker the services themselves are all there is to report
+		services, err := agent.provider.Running(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, service := range services {
+			status.Services = append(status.Services, &pb.AgentStatus_AgentService{Id: string(service)})
+		}
+		return status, nil
+	}
 
-	containers, err := agent.dockerCli.ContainerList(ctx, dockerTypes.ContainerListOptions{})
+	containers, err := agent.runtime.ContainerList(ctx, dockerTypes.ContainerListOptions{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -52,14 +83,29 @@ func (agent *Agent) AgentGetStatus(ctx context.Context) (*pb.AgentStatus, error)
 }
 
 func (agent *Agent) startConfigHandler(queue chan consul.KVPairs) {
+	var latest consul.KVPairs
 	for {
-		kvs := <-queue
-		agent.sync(kvs)
+		select {
+		case latest = <-queue:
+		case <-agent.maintenance.Resumed():
+			if latest == nil {
+				continue
+			}
+			// Services may have been stopped or reconfigured by hand meanwhile, so reconcile everything
+			agent.snapshot.Reset()
+		}
+		// While paused, hold on to the latest config, it's applied once reconciliation resumes
+		agent.maintenance.Reconcile(func() {
+			agent.sync(latest)
+		})
 	}
 }
 
+// sync makes the running services match the desired ones, which only takes local calls and is done every time, so
+// managers that crashed or were removed by hand come back. Only services that were (re)started or whose config
+// subtree changed since it was last applied are sent their config.
 func (agent *Agent) sync(kvs consul.KVPairs) {
-	m, err := consulkvjson.ConsulKVsToJSON(kvs)
+	m, err := consulkvjson.ConsulKVsToJSON(withoutStatusKeys(kvs))
 	if err != nil {
 		log.Panic(err)
 	}
@@ -68,193 +114,203 @@ func (agent *Agent) sync(kvs consul.KVPairs) {
 		log.Panic(err)
 	}
 
+	// json.Marshal sorts map keys, so the hash of a service's subtree only changes with its config
+	desired := map[Service]string{}
 	servicesMapString, valueType, _, err := jsonparser.Get(jsonString, "instances", InstanceID, "services")
-	if valueType == jsonparser.NotExist {
-		agent.ensureServices(Services{})
-		return
-	}
-
-	if err != nil {
-		log.Fatal(err)
+	if valueType != jsonparser.NotExist {
+		if err != nil {
+			log.Fatal(err)
+		}
+		jsonparser.ObjectEach(servicesMapString, func(key, value []byte, dataType jsonparser.ValueType, offset int) error {
+			desired[Service(key)] = configHash(value)
+			return nil
+		})
 	}
 
 	incomingServices := Services{}
-	jsonparser.ObjectEach(servicesMapString, func(key, value []byte, dataType jsonparser.ValueType, offset int) error {
-		service := Service(key)
+	for service := range desired {
 		incomingServices = append(incomingServices, service)
-		return nil
-	})
+	}
+	sort.Slice(incomingServices, func(i, j int) bool { return incomingServices[i] < incomingServices[j] })
+	started, _ := agent.ensureServices(incomingServices)
 
-	agent.ensureServices(incomingServices)
 	localServices, err := agent.getLocalServices()
 	if err != nil {
 		log.Fatal(err)
 	}
-	agent.configureServices(localServices)
+	// Both are local and idempotent, and managers that outlived the agent or lost their registration along with a
+	// restarted Consul agent are only found again through them
+	agent.syncFirewall(localServices)
+	agent.registerManagers(localServices)
+	agent.managers.Retain(localServices)
+
+	// Started services have a new manager without any config, whatever was applied to the old one
+	toConfigure := Services{}
+	for _, service := range localServices {
+		if _, found := desired[service]; found && (started.contains(service) || agent.snapshot.Changed(service, desired[service])) {
+			toConfigure = append(toConfigure, service)
+		}
+	}
+	sort.Slice(toConfigure, func(i, j int) bool { return toConfigure[i] < toConfigure[j] })
+	agent.configureServices(toConfigure, desired)
 }
 
-func (agent *Agent) getLocalServices() (Services, error) {
-	args := filters.NewArgs(
-		filters.Arg("label", "com.opencopilot.managed"),
-	)
-	containers, err := agent.dockerCli.ContainerList(context.Background(), dockerTypes.ContainerListOptions{
-		Filters: args,
-	})
+// syncFirewall opens the ports the running services publish or declare open, and closes all others
+func (agent *Agent) syncFirewall(services Services) {
+	if agent.firewall == nil {
+		return
+	}
+
+	catalog, err := loadCatalog(CatalogPath)
 	if err != nil {
-		log.Panic(err)
+		log.Fatal(err)
 	}
 
-	localServices := Services{}
-	for _, container := range containers {
-		serviceName, found := container.Labels["com.opencopilot.service-manager"]
-		if !found {
-			continue
+	ports := []nat.Port{}
+	for _, service := range services {
+		if entry, found := catalog[service]; found {
+			ports = append(append(ports, entry.Ports...), entry.OpenPorts...)
 		}
-		// fmt.Printf("%s %s %v\n", container.ID[:10], container.Image, serviceName)
-		service := Service(serviceName)
-		localServices = append(localServices, service)
 	}
-	return localServices, nil
+
+	if err := agent.firewall.Sync(ports); err != nil {
+		// TODO: do something else here
+		log.Println(err)
+	}
 }
 
-func (agent *Agent) ensureServices(incomingServices Services) {
+func (agent *Agent) getLocalServices() (Services, error) {
+	return agent.provider.Running(context.Background())
+}
+
+// ensureServices makes the running services match incomingServices: missing services are started, services that
+// are no longer wanted are stopped, and services whose definition drifted from the catalog are recreated.
+// It returns the services it started, recreated ones included, and the services it stopped.
+func (agent *Agent) ensureServices(incomingServices Services) (Services, Services) {
 	localServices, err := agent.getLocalServices()
 	if err != nil {
 		log.Panicln(err)
 	}
+	catalog, err := loadCatalog(CatalogPath)
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	running := map[Service]bool{}
+	for _, localService := range localServices {
+		running[localService] = true
+	}
+	wanted := map[Service]bool{}
 	for _, incomingService := range incomingServices {
-		// For every service we should have, go check all the services we're currently running
-		existsLocally := false
-		for _, localService := range localServices {
-			// If an incoming service is already running, do nothing
-			if incomingService == localService {
-				existsLocally = true
-			}
-		}
+		wanted[incomingService] = true
+	}
 
-		// If we didn't find that this incoming service exists locally, start it
-		if existsLocally {
-			break
-		} else {
-			err := agent.startService(incomingService)
-			if err != nil {
+	started := Services{}
+	stopped := Services{}
+	for _, incomingService := range incomingServices {
+		if !running[incomingService] {
+			if err := agent.startService(incomingService); err != nil {
 				// TODO: do something else here
 				log.Println(err)
+				continue
 			}
+			started = append(started, incomingService)
+			continue
+		}
+
+		entry, found := catalog[incomingService]
+		if !found {
+			continue
 		}
+		drift, err := agent.provider.Drift(context.Background(), incomingService, entry)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if len(drift) == 0 {
+			continue
+		}
+		log.Printf("recreating service %s, its %s drifted from the catalog\n", string(incomingService), strings.Join(drift, ", "))
+		if err := agent.stopService(incomingService); err != nil {
+			log.Println(err)
+		}
+		if err := agent.startService(incomingService); err != nil {
+			log.Println(err)
+			stopped = append(stopped, incomingService)
+			continue
+		}
+		started = append(started, incomingService)
 	}
 
 	for _, localService := range localServices {
-		// For every locally running service, check if it should be running from the incoming services
-		existsIncoming := false
-		for _, incomingService := range incomingServices {
-			if localService == incomingService {
-				existsIncoming = true
-			}
+		if wanted[localService] {
+			continue
 		}
-
-		// If we didn't find that this local service exists in the incoming specification, stop it
-		if existsIncoming {
-			break
-		} else {
-			err := agent.stopService(localService)
-			if err != nil {
-				// TODO: do something else here
-				log.Println(err)
-			}
+		if err := agent.stopService(localService); err != nil {
+			// TODO: do something else here
+			log.Println(err)
 		}
-
+		stopped = append(stopped, localService)
 	}
+	return started, stopped
 }
 
 func (agent *Agent) startService(service Service) error {
 	log.Printf("adding service: %s\n", string(service))
 
-	ctx := context.Background()
-	serviceImageYaml, err := ioutil.ReadFile("./services.yaml")
+	catalog, err := loadCatalog(CatalogPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	serviceImageMap := make(map[interface{}]interface{})
-	yamlErr := yaml.Unmarshal(serviceImageYaml, &serviceImageMap)
-	if yamlErr != nil {
-		log.Fatal(yamlErr)
-	}
 
-	if serviceImageMap[string(service)] == nil {
+	entry, found := catalog[service]
+	if !found {
 		return errors.New("invalid service specified")
 	}
 
-	containerConfig := &container.Config{
-		Labels: map[string]string{
-			"com.opencopilot.managed":         "",
-			"com.opencopilot.service-manager": string(service),
-		},
-		Image: serviceImageMap[string(service)].(string),
-	}
-
-	reader, err := agent.dockerCli.ImagePull(ctx, containerConfig.Image, dockerTypes.ImagePullOptions{})
-	if err != nil {
+	if err := agent.runHooks(service, "pre-start", entry.Hooks.PreStart, nil); err != nil {
 		return err
 	}
 
-	defer reader.Close()
-	if _, err := ioutil.ReadAll(reader); err != nil {
-		log.Panic(err)
-	}
+	return agent.provider.Start(context.Background(), service, entry)
+}
 
-	containerConfig.Env = []string{"CONFIG_DIR=" + ConfigDir, "INSTANCE_ID=" + InstanceID}
+func (agent *Agent) stopService(service Service) error {
+	log.Printf("stopping service: %s\n", string(service))
 
-	res, err := agent.dockerCli.ContainerCreate(ctx, containerConfig, &container.HostConfig{
-		AutoRemove: true, // Important to remove container after it's stopped, so that we can start a new one up with the same name if this service gets re-added
-		Privileged: true, // So that the manager containers can start other docker containers,
-		Binds: []string{ // So that the manager containers have access to Docker on the host
-			"/var/run/docker.sock:/var/run/docker.sock",
-			ConfigDir + ":" + ConfigDir,
-		},
-		PublishAllPorts: true,
-	}, nil, "com.opencopilot.service-manager."+string(service))
-	if err != nil {
-		return err
+	if err := agent.provider.Stop(context.Background(), service); err != nil {
+		// TODO: do something else here
+		log.Println(err)
 	}
 
-	startErr := agent.dockerCli.ContainerStart(ctx, res.ID, dockerTypes.ContainerStartOptions{})
-	if startErr != nil {
-		return startErr
+	agent.managers.Remove(service)
+	agent.status.Clear(service)
+	agent.snapshot.Forget(service)
+	if err := agent.registry.ServiceDeregister(managerServiceID(service)); err != nil {
+		log.Println(err)
 	}
 
-	return nil
-}
-
-func (agent *Agent) stopService(service Service) error {
-	log.Printf("stopping service: %s\n", string(service))
-
-	ctx := context.Background()
-	args := filters.NewArgs(
-		filters.Arg("label", "com.opencopilot.managed"),
-		filters.Arg("name", "com.opencopilot.service-manager."+string(service)),
-	)
-	containers, err := agent.dockerCli.ContainerList(ctx, dockerTypes.ContainerListOptions{
-		Filters: args,
-	})
+	catalog, err := loadCatalog(CatalogPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for _, container := range containers {
-		agent.dockerCli.ContainerStop(ctx, container.ID, nil)
+	if entry, found := catalog[service]; found {
+		if err := agent.backupVolumes(service, entry); err != nil {
+			// The volume is still there, a failed backup is no reason to skip the post-stop hooks
+			log.Println(err)
+		}
+		return agent.runHooks(service, "post-stop", entry.Hooks.PostStop, nil)
 	}
 
 	return nil
 }
 
 func (agent *Agent) getServiceConfig(service Service) ([]byte, error) {
-	kv := agent.consulCli.KV()
-	kvs, _, err := kv.List("instances/"+InstanceID+"/services/"+string(service), &consul.QueryOptions{})
+	kvs, _, err := agent.configStore.List("instances/"+InstanceID+"/services/"+string(service), &consul.QueryOptions{})
 	if err != nil {
 		log.Fatal(err)
 	}
-	configMap, err := consulkvjson.ConsulKVsToJSON(kvs)
+	configMap, err := consulkvjson.ConsulKVsToJSON(withoutStatusKeys(kvs))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -275,63 +331,63 @@ func (agent *Agent) getServiceConfig(service Service) ([]byte, error) {
 	return serviceConfig, nil
 }
 
-func (agent *Agent) getServiceGRPCPort(service Service) (uint16, error) {
-	ctx := context.Background()
-	args := filters.NewArgs(
-		filters.Arg("label", "com.opencopilot.managed"),
-		filters.Arg("name", "com.opencopilot.service-manager."+string(service)),
-	)
-	containers, err := agent.dockerCli.ContainerList(ctx, dockerTypes.ContainerListOptions{
-		Filters: args,
-	})
+// configureService sends the config of service to its manager, returning the hash of the config it sent
+func (agent *Agent) configureService(service Service) (string, error) {
+	serviceConfig, err := agent.getServiceConfig(service)
 	if err != nil {
-		return 0, err
+		return "", err
 	}
+	hash := configHash(serviceConfig)
 
-	for _, container := range containers {
-		for _, portPair := range container.Ports {
-			if portPair.PrivatePort == 50052 {
-				return portPair.PublicPort, nil
-			}
-		}
-	}
-
-	return 0, errors.New("Could not find gRPC port")
-}
-
-func (agent *Agent) configureService(service Service) error {
-	serviceConfig, err := agent.getServiceConfig(service)
+	target, err := agent.getServiceGRPCTarget(service)
 	if err != nil {
-		return err
+		return hash, err
 	}
 
-	gRPCPort, err := agent.getServiceGRPCPort(service)
+	conn, err := agent.managers.Get(service, target)
 	if err != nil {
-		return err
+		return hash, err
 	}
 
-	conn, err := grpc.Dial("localhost:"+strconv.Itoa(int(gRPCPort)), grpc.WithInsecure())
+	catalog, err := loadCatalog(CatalogPath)
 	if err != nil {
-		return err
+		log.Fatal(err)
+	}
+	if entry, found := catalog[service]; found && entry.Canary != nil {
+		err := rollOut(context.Background(), conn, serviceConfig, entry.Canary)
+		if err != errNoCanary {
+			return hash, err
+		}
+		log.Printf("manager of %s doesn't support candidate configs, configuring it without canary\n", string(service))
 	}
-	defer conn.Close()
 
-	client := managerPb.NewManagerClient(conn)
-	_, errConfiguring := client.Configure(context.Background(), &managerPb.ConfigureRequest{Config: string(serviceConfig)})
+	_, errConfiguring := sendConfig(context.Background(), conn, serviceConfig, false)
 	if errConfiguring != nil {
-		return errConfiguring
+		return hash, errConfiguring
 	}
 
-	return nil
+	return hash, nil
 }
 
-func (agent *Agent) configureServices(services Services) []error {
+// configureServices sends services their config, recording the desired hash of those that took it or rejected it
+// after verification. Services that failed otherwise are forgotten, so they are retried on the next sync.
+func (agent *Agent) configureServices(services Services, desired map[Service]string) []error {
 	var errorList []error
 	for _, service := range services {
-		err := agent.configureService(service)
+		hash, err := agent.configureService(service)
+		agent.status.Report(service, hash, err)
+		if _, rejected := err.(*verificationError); rejected {
+			// The manager is back on its last good config, pushing the bad one again would only take it down again
+			agent.snapshot.Applied(service, desired[service])
+			errorList = append(errorList, err)
+			continue
+		}
 		if err != nil {
+			agent.snapshot.Forget(service)
 			errorList = append(errorList, err)
+			continue
 		}
+		agent.snapshot.Applied(service, desired[service])
 	}
 	return errorList
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	consul "github.com/hashicorp/consul/api"
+)
+
+const testCatalog = `
+lb:
+  image: "quay.io/opencopilot/haproxy-manager"
+  ports:
+    - "80/tcp"
+dns: "quay.io/opencopilot/dns-manager"
+`
+
+// testAgent is an Agent wired to fakes, with the fakes at hand
+type testAgent struct {
+	*Agent
+	store    *FakeConfigStore
+	provider *FakeServiceProvider
+	registry *FakeServiceRegistry
+	firewall *FakeFirewall
+	dialer   *FakeManagerDialer
+}
+
+// newTestAgent sets up an agent on instance "test-instance" with catalog as its catalog, cleanup restores the globals
+// it changes
+func newTestAgent(t *testing.T, catalog string) (*testAgent, func()) {
+	dir, err := ioutil.TempDir("", "agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalogPath := filepath.Join(dir, "services.yaml")
+	if err := ioutil.WriteFile(catalogPath, []byte(catalog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	previousInstanceID, previousConfigDir, previousCatalogPath := InstanceID, ConfigDir, CatalogPath
+	InstanceID, ConfigDir, CatalogPath = "test-instance", dir, catalogPath
+	cleanup := func() {
+		InstanceID, ConfigDir, CatalogPath = previousInstanceID, previousConfigDir, previousCatalogPath
+		os.RemoveAll(dir)
+	}
+
+	store := &FakeConfigStore{}
+	provider := &FakeServiceProvider{Targets: map[Service]string{"lb": "127.0.0.1:50001", "dns": "127.0.0.1:50002"}}
+	registry := &FakeServiceRegistry{}
+	firewall := &FakeFirewall{}
+	dialer := &FakeManagerDialer{}
+	return &testAgent{
+		Agent: &Agent{
+			provider:    provider,
+			configStore: store,
+			managers:    newManagerPool(dialer.Dial),
+			firewall:    firewall,
+			registry:    registry,
+			status:      newStatusReporter(store),
+			snapshot:    newConfigSnapshot(),
+		},
+		store:    store,
+		provider: provider,
+		registry: registry,
+		firewall: firewall,
+		dialer:   dialer,
+	}, cleanup
+}
+
+// setConfig sets a key of the config of service
+func (agent *testAgent) setConfig(service Service, key string, value string) {
+	agent.store.Set("instances/"+InstanceID+"/services/"+string(service)+"/"+key, []byte(value))
+}
+
+// deleteConfig removes a key of the config of service
+func (agent *testAgent) deleteConfig(service Service, key string) {
+	agent.store.Delete("instances/"+InstanceID+"/services/"+string(service)+"/"+key, nil)
+}
+
+// syncStore syncs the agent with the instance's config tree, as watchConfigTree would
+func (agent *testAgent) syncStore(t *testing.T) {
+	kvs, _, err := agent.store.List("instances/"+InstanceID, &consul.QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.sync(kvs)
+}
+
+// configs returns the configs the manager of service was sent
+func (agent *testAgent) configs(service Service) []string {
+	conn, err := agent.dialer.Dial(agent.provider.Targets[service])
+	if err != nil {
+		return nil
+	}
+	fake := conn.(*FakeManagerConn)
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([]string{}, fake.Configs...)
+}
+
+func (agent *testAgent) running(t *testing.T, service Service) bool {
+	services, err := agent.provider.Running(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return services.contains(service)
+}
+
+func TestSyncStartsAndConfiguresServices(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.setConfig("lb", "backend", "10.0.0.1")
+
+	agent.syncStore(t)
+
+	if !agent.running(t, "lb") {
+		t.Fatal("lb was not started")
+	}
+	if _, found := agent.registry.Registrations[managerServiceID("lb")]; !found {
+		t.Error("lb was not registered")
+	}
+	if !reflect.DeepEqual(agent.firewall.Open, []nat.Port{"80/tcp"}) {
+		t.Errorf("expected port 80/tcp to be open, got %v", agent.firewall.Open)
+	}
+	if configs := agent.configs("lb"); !reflect.DeepEqual(configs, []string{`{"backend":"10.0.0.1"}`}) {
+		t.Errorf("unexpected configs sent to lb: %v", configs)
+	}
+}
+
+func TestSyncOnlyConfiguresChangedServices(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	agent.setConfig("dns", "zone", "example.com")
+	agent.syncStore(t)
+
+	agent.syncStore(t)
+	if configs := agent.configs("lb"); len(configs) != 1 {
+		t.Errorf("lb was configured again without changes: %v", configs)
+	}
+
+	agent.setConfig("dns", "zone", "example.org")
+	agent.syncStore(t)
+	if configs := agent.configs("lb"); len(configs) != 1 {
+		t.Errorf("lb was configured again for a change to dns: %v", configs)
+	}
+	if configs := agent.configs("dns"); len(configs) != 2 || configs[1] != `{"zone":"example.org"}` {
+		t.Errorf("dns was not sent its new config: %v", configs)
+	}
+}
+
+func TestSyncRestartsAndConfiguresCrashedServices(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	agent.syncStore(t)
+
+	// The manager goes away while the config stays the same
+	agent.provider.Stop(context.Background(), "lb")
+	agent.syncStore(t)
+
+	if !agent.running(t, "lb") {
+		t.Fatal("lb was not restarted")
+	}
+	if configs := agent.configs("lb"); len(configs) != 2 {
+		t.Errorf("restarted lb was not sent its config: %v", configs)
+	}
+}
+
+func TestSyncAdoptsManagersAlreadyRunning(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	// The agent restarted while lb kept running, and the Consul agent lost its registration
+	entry, _ := loadCatalog(CatalogPath)
+	agent.provider.Start(context.Background(), "lb", entry["lb"])
+	agent.setConfig("lb", "backend", "10.0.0.1")
+
+	agent.syncStore(t)
+	agent.syncStore(t)
+
+	if _, found := agent.registry.Registrations[managerServiceID("lb")]; !found {
+		t.Error("lb was not registered")
+	}
+	if !reflect.DeepEqual(agent.firewall.Open, []nat.Port{"80/tcp"}) {
+		t.Errorf("expected port 80/tcp to be open, got %v", agent.firewall.Open)
+	}
+	if configs := agent.configs("lb"); !reflect.DeepEqual(configs, []string{`{"backend":"10.0.0.1"}`}) {
+		t.Errorf("expected lb to be sent its config once, got %v", configs)
+	}
+
+	// Registrations lost while the agent runs come back on the next sync as well
+	agent.registry.ServiceDeregister(managerServiceID("lb"))
+	agent.syncStore(t)
+	if _, found := agent.registry.Registrations[managerServiceID("lb")]; !found {
+		t.Error("lb was not registered again")
+	}
+}
+
+func TestSyncStopsRemovedServicesThatFailedToConfigure(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	conn, _ := agent.dialer.Dial(agent.provider.Targets["lb"])
+	conn.(*FakeManagerConn).ConfigureErr = errors.New("invalid config")
+	agent.setConfig("lb", "backend", "not an address")
+	agent.syncStore(t)
+	if !agent.running(t, "lb") {
+		t.Fatal("lb was not started")
+	}
+
+	agent.deleteConfig("lb", "backend")
+	agent.syncStore(t)
+
+	if agent.running(t, "lb") {
+		t.Error("lb was not stopped")
+	}
+	if _, found := agent.registry.Registrations[managerServiceID("lb")]; found {
+		t.Error("lb was not deregistered")
+	}
+	if len(agent.firewall.Open) != 0 {
+		t.Errorf("expected no open ports, got %v", agent.firewall.Open)
+	}
+}
+
+func TestSyncRetriesFailedConfigs(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	conn, _ := agent.dialer.Dial(agent.provider.Targets["lb"])
+	fake := conn.(*FakeManagerConn)
+	fake.ConfigureErr = errors.New("unavailable")
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	agent.syncStore(t)
+
+	fake.ConfigureErr = nil
+	agent.syncStore(t)
+
+	if configs := agent.configs("lb"); len(configs) != 1 {
+		t.Errorf("lb was not sent its config again: %v", configs)
+	}
+}
+
+func TestEnsureServices(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+
+	started, stopped := agent.ensureServices(Services{"lb", "dns"})
+	if !reflect.DeepEqual(started, Services{"lb", "dns"}) || len(stopped) != 0 {
+		t.Errorf("expected lb and dns to be started, got started %v and stopped %v", started, stopped)
+	}
+
+	started, stopped = agent.ensureServices(Services{"lb"})
+	if len(started) != 0 || !reflect.DeepEqual(stopped, Services{"dns"}) {
+		t.Errorf("expected dns to be stopped, got started %v and stopped %v", started, stopped)
+	}
+
+	started, stopped = agent.ensureServices(Services{"lb", "unknown"})
+	if len(started) != 0 || len(stopped) != 0 {
+		t.Errorf("expected nothing to change, got started %v and stopped %v", started, stopped)
+	}
+}
+
+func TestEnsureServicesRecreatesDriftedServices(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.ensureServices(Services{"lb"})
+
+	if err := ioutil.WriteFile(CatalogPath, []byte(`lb: "quay.io/opencopilot/haproxy-manager:v2"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	started, stopped := agent.ensureServices(Services{"lb"})
+
+	if !reflect.DeepEqual(started, Services{"lb"}) || len(stopped) != 0 {
+		t.Errorf("expected lb to be recreated, got started %v and stopped %v", started, stopped)
+	}
+	if image := agent.provider.Services["lb"].Image; image != "quay.io/opencopilot/haproxy-manager:v2" {
+		t.Errorf("lb runs %s", image)
+	}
+}
+
+func TestEnsureServicesSkipsServicesThatFailToStart(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.provider.StartErr = errors.New("no such image")
+
+	started, stopped := agent.ensureServices(Services{"lb"})
+	if len(started) != 0 || len(stopped) != 0 {
+		t.Errorf("expected nothing to change, got started %v and stopped %v", started, stopped)
+	}
+}
+
+func TestConfigureServices(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	agent.setConfig("dns", "zone", "example.com")
+	agent.ensureServices(Services{"lb", "dns"})
+	agent.registerManagers(Services{"lb", "dns"})
+	conn, _ := agent.dialer.Dial(agent.provider.Targets["dns"])
+	conn.(*FakeManagerConn).ConfigureErr = errors.New("invalid config")
+
+	errs := agent.configureServices(Services{"lb", "dns"}, map[Service]string{"lb": "lb-hash", "dns": "dns-hash"})
+
+	if len(errs) != 1 {
+		t.Errorf("expected dns to fail, got %v", errs)
+	}
+	if agent.snapshot.Changed("lb", "lb-hash") {
+		t.Error("lb's config was not recorded as applied")
+	}
+	if !agent.snapshot.Changed("dns", "dns-hash") {
+		t.Error("dns's config was recorded as applied")
+	}
+}
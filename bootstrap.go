@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const bootstrapTimeout = 30 * time.Second
+
+// instanceIDFile is where a derived instance ID is persisted, so the device keeps its identity across restarts
+func instanceIDFile() string {
+	return filepath.Join(ConfigDir, "instance-id")
+}
+
+// machineIDFiles are where systemd and dbus keep the machine ID
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// bootstrapInstanceID works out the instance ID when INSTANCE_ID isn't set, first from a previously persisted ID,
+// then from source: the identity provider's metadata service, the machine ID or a bootstrap token exchange
+func bootstrapInstanceID(source string, identityProvider IdentityProvider) (string, error) {
+	if ConfigDir != "" {
+		if persisted, err := ioutil.ReadFile(instanceIDFile()); err == nil {
+			if instanceID := strings.TrimSpace(string(persisted)); instanceID != "" {
+				return instanceID, nil
+			}
+		}
+	}
+
+	var instanceID string
+	var err error
+	switch source {
+	case "":
+		return "", errors.New("No instance ID specified")
+	case "metadata":
+		instanceID, err = instanceIDFromMetadata(identityProvider)
+	case "machine-id":
+		instanceID, err = instanceIDFromMachineID()
+	case "bootstrap":
+		instanceID, err = instanceIDFromBootstrap(BootstrapURL, BootstrapToken)
+	default:
+		return "", fmt.Errorf("unsupported INSTANCE_ID_SOURCE %q, expected metadata, machine-id or bootstrap", source)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to derive instance ID from %s: %v", source, err)
+	}
+	if instanceID == "" {
+		return "", fmt.Errorf("failed to derive instance ID from %s: empty ID", source)
+	}
+
+	if ConfigDir == "" {
+		log.Println("warning: CONFIG_DIR is not set, the derived instance ID won't be persisted")
+		return instanceID, nil
+	}
+	if err := ioutil.WriteFile(instanceIDFile(), []byte(instanceID+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to persist instance ID: %v", err)
+	}
+	return instanceID, nil
+}
+
+func instanceIDFromMetadata(identityProvider IdentityProvider) (string, error) {
+	if identityProvider == nil {
+		return "", errors.New("IDENTITY_PROVIDER is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), identityFetchTimeout)
+	defer cancel()
+	identity, err := identityProvider.Fetch(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	return identity.InstanceID, nil
+}
+
+func instanceIDFromMachineID() (string, error) {
+	for _, path := range machineIDFiles {
+		machineID, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(machineID)), nil
+	}
+	return "", errors.New("no machine ID found")
+}
+
+// instanceIDFromBootstrap trades a one-time bootstrap token for an instance ID assigned by the control plane
+func instanceIDFromBootstrap(url string, token string) (string, error) {
+	if url == "" || token == "" {
+		return "", errors.New("BOOTSTRAP_URL and BOOTSTRAP_TOKEN are required")
+	}
+
+	// The machine ID lets the control plane hand the same ID back if the exchange is retried after a lost response
+	machineID, _ := instanceIDFromMachineID()
+	body, err := json.Marshal(map[string]string{"token": token, "machine_id": machineID})
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: bootstrapTimeout}
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("POST %s: %s", url, res.Status)
+	}
+
+	var exchanged struct {
+		InstanceID string `json:"instance_id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&exchanged); err != nil {
+		return "", err
+	}
+	return exchanged.InstanceID, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withBootstrapDir points ConfigDir and the machine ID at a temporary directory, cleanup restores the globals it
+// changes and removes the directory
+func withBootstrapDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "bootstrap-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousConfigDir, previousMachineIDFiles := ConfigDir, machineIDFiles
+	previousURL, previousToken := BootstrapURL, BootstrapToken
+	ConfigDir = dir
+	machineIDFiles = []string{filepath.Join(dir, "missing-machine-id"), filepath.Join(dir, "machine-id")}
+	return dir, func() {
+		ConfigDir, machineIDFiles = previousConfigDir, previousMachineIDFiles
+		BootstrapURL, BootstrapToken = previousURL, previousToken
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBootstrapPersistedInstanceID(t *testing.T) {
+	_, cleanup := withBootstrapDir(t)
+	defer cleanup()
+	ioutil.WriteFile(instanceIDFile(), []byte("persisted-id\n"), 0600)
+
+	// The persisted ID wins over any source, even one that can't work
+	instanceID, err := bootstrapInstanceID("bootstrap", nil)
+	if err != nil || instanceID != "persisted-id" {
+		t.Errorf("expected the persisted ID, got %q (%v)", instanceID, err)
+	}
+}
+
+func TestBootstrapFromMachineID(t *testing.T) {
+	dir, cleanup := withBootstrapDir(t)
+	defer cleanup()
+	ioutil.WriteFile(filepath.Join(dir, "machine-id"), []byte("0123456789abcdef\n"), 0644)
+
+	instanceID, err := bootstrapInstanceID("machine-id", nil)
+	if err != nil || instanceID != "0123456789abcdef" {
+		t.Fatalf("expected the machine ID, got %q (%v)", instanceID, err)
+	}
+	persisted, err := ioutil.ReadFile(instanceIDFile())
+	if err != nil || string(persisted) != "0123456789abcdef\n" {
+		t.Errorf("the ID was not persisted: %q (%v)", persisted, err)
+	}
+}
+
+func TestBootstrapFromMetadata(t *testing.T) {
+	_, cleanup := withBootstrapDir(t)
+	defer cleanup()
+
+	if _, err := bootstrapInstanceID("metadata", nil); err == nil {
+		t.Error("expected metadata without an identity provider to fail")
+	}
+	provider := &FakeIdentityProvider{Identity: &IdentityDocument{Provider: "aws", InstanceID: "i-0123456789"}}
+	instanceID, err := bootstrapInstanceID("metadata", provider)
+	if err != nil || instanceID != "i-0123456789" {
+		t.Errorf("expected the metadata instance ID, got %q (%v)", instanceID, err)
+	}
+}
+
+func TestBootstrapExchange(t *testing.T) {
+	dir, cleanup := withBootstrapDir(t)
+	defer cleanup()
+	ioutil.WriteFile(filepath.Join(dir, "machine-id"), []byte("0123456789abcdef\n"), 0644)
+	controlPlane := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var exchange map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&exchange); err != nil || exchange["token"] != "one-time-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"instance_id": "device-` + exchange["machine_id"] + `"}`))
+	}))
+	defer controlPlane.Close()
+
+	if _, err := bootstrapInstanceID("bootstrap", nil); err == nil {
+		t.Error("expected the exchange to fail without BOOTSTRAP_URL and BOOTSTRAP_TOKEN")
+	}
+
+	BootstrapURL, BootstrapToken = controlPlane.URL, "stolen-token"
+	if _, err := bootstrapInstanceID("bootstrap", nil); err == nil {
+		t.Error("expected a refused token to fail the exchange")
+	}
+
+	BootstrapToken = "one-time-token"
+	instanceID, err := bootstrapInstanceID("bootstrap", nil)
+	if err != nil || instanceID != "device-0123456789abcdef" {
+		t.Errorf("expected the exchanged ID, got %q (%v)", instanceID, err)
+	}
+}
+
+func TestBootstrapFailures(t *testing.T) {
+	dir, cleanup := withBootstrapDir(t)
+	defer cleanup()
+
+	if _, err := bootstrapInstanceID("", nil); err == nil {
+		t.Error("expected no source to fail")
+	}
+	if _, err := bootstrapInstanceID("hostname", nil); err == nil {
+		t.Error("expected an unknown source to fail")
+	}
+	if _, err := bootstrapInstanceID("machine-id", nil); err == nil {
+		t.Error("expected a missing machine ID to fail")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "machine-id"), []byte("\n"), 0644)
+	if _, err := bootstrapInstanceID("machine-id", nil); err == nil {
+		t.Error("expected an empty machine ID to fail")
+	}
+	if _, err := os.Stat(instanceIDFile()); !os.IsNotExist(err) {
+		t.Error("an empty ID was persisted")
+	}
+}
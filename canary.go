@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	managerPb "github.com/opencopilot/agent/manager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultCanaryTimeout = 30 * time.Second
+	probeInterval        = time.Second
+)
+
+// Canary has a service's config pushed as a candidate and verified before it is committed, so a bad config
+// pushed to the whole fleet is reverted by every manager instead of taking it down
+type Canary struct {
+	// Delay is how long to wait after pushing the candidate before probing it
+	Delay time.Duration `yaml:"delay"`
+	// Timeout is how long the probe gets to pass, defaults to 30s
+	Timeout time.Duration `yaml:"timeout"`
+	Probe   Probe         `yaml:"probe"`
+}
+
+// Probe checks a candidate config, exactly one kind of check is set
+type Probe struct {
+	// Manager checks that the manager reports itself healthy
+	Manager bool `yaml:"manager"`
+	// HTTP expects a 2xx response to a GET of the URL
+	HTTP string `yaml:"http"`
+	// TCP expects host:port to accept connections
+	TCP string `yaml:"tcp"`
+}
+
+// errNoCanary is a manager that doesn't implement ConfigureCandidate, built before canaries existed
+var errNoCanary = errors.New("manager doesn't support candidate configs")
+
+// verificationError is a candidate config that failed its probe and was reverted
+type verificationError struct {
+	err error
+}
+
+func (e *verificationError) Error() string {
+	return fmt.Sprintf("config failed verification and was reverted: %v", e.err)
+}
+
+func (canary *Canary) validate() error {
+	checks := 0
+	if canary.Probe.Manager {
+		checks++
+	}
+	if canary.Probe.HTTP != "" {
+		if _, err := url.ParseRequestURI(canary.Probe.HTTP); err != nil {
+			return fmt.Errorf("invalid http probe %q: %v", canary.Probe.HTTP, err)
+		}
+		checks++
+	}
+	if canary.Probe.TCP != "" {
+		if _, _, err := net.SplitHostPort(canary.Probe.TCP); err != nil {
+			return fmt.Errorf("invalid tcp probe %q: %v", canary.Probe.TCP, err)
+		}
+		checks++
+	}
+	if checks != 1 {
+		return errors.New("canary probe needs exactly one of manager, http or tcp")
+	}
+	return nil
+}
+
+func (canary *Canary) timeout() time.Duration {
+	if canary.Timeout == 0 {
+		return defaultCanaryTimeout
+	}
+	return canary.Timeout
+}
+
+// check runs the probe once
+func (probe *Probe) check(ctx context.Context, conn ManagerConn) error {
+	switch {
+	case probe.Manager:
+		managerStatus, err := conn.GetStatus(ctx, &managerPb.ManagerStatusRequest{})
+		if err != nil {
+			return err
+		}
+		if managerStatus.Health != managerPb.ManagerStatus_HEALTHY {
+			return fmt.Errorf("manager reports %s", managerStatus.Health)
+		}
+		return nil
+	case probe.HTTP != "":
+		req, err := http.NewRequest("GET", probe.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("GET %s: %s", probe.HTTP, res.Status)
+		}
+		return nil
+	default:
+		var dialer net.Dialer
+		tcpConn, err := dialer.DialContext(ctx, "tcp", probe.TCP)
+		if err != nil {
+			return err
+		}
+		return tcpConn.Close()
+	}
+}
+
+// verify probes until the probe passes or the canary times out, returning the last failure
+func (canary *Canary) verify(ctx context.Context, conn ManagerConn) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(canary.Delay):
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, canary.timeout())
+	defer cancel()
+	for {
+		err := canary.Probe.check(ctx, conn)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(probeInterval):
+		}
+	}
+}
+
+// rollOut pushes config to the manager as a candidate and commits it if it passes the canary's probe, reverting
+// it otherwise. It fails with errNoCanary, having pushed nothing, if the manager has no canary support.
+func rollOut(ctx context.Context, conn ManagerConn, config []byte, canary *Canary) error {
+	if _, err := sendConfig(ctx, conn, config, true); err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return errNoCanary
+		}
+		return err
+	}
+
+	if err := canary.verify(ctx, conn); err != nil {
+		if _, revertErr := conn.Revert(ctx, &managerPb.RevertRequest{}); revertErr != nil {
+			return fmt.Errorf("config failed verification (%v) and could not be reverted: %v", err, revertErr)
+		}
+		return &verificationError{err: err}
+	}
+
+	_, err := conn.Commit(ctx, &managerPb.CommitRequest{})
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	managerPb "github.com/opencopilot/agent/manager"
+)
+
+func TestCanaryValidate(t *testing.T) {
+	valid := []Canary{
+		{Probe: Probe{Manager: true}},
+		{Probe: Probe{HTTP: "http://127.0.0.1/health"}},
+		{Probe: Probe{TCP: "127.0.0.1:443"}},
+	}
+	for _, canary := range valid {
+		if err := canary.validate(); err != nil {
+			t.Errorf("expected %+v to be valid, got %v", canary, err)
+		}
+	}
+
+	invalid := []Canary{
+		{},
+		{Probe: Probe{Manager: true, TCP: "127.0.0.1:443"}},
+		{Probe: Probe{HTTP: "health"}},
+		{Probe: Probe{TCP: "127.0.0.1"}},
+	}
+	for _, canary := range invalid {
+		if err := canary.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", canary)
+		}
+	}
+}
+
+func TestProbes(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	conn := &FakeManagerConn{Health: managerPb.ManagerStatus_HEALTHY}
+	sick := &FakeManagerConn{Health: managerPb.ManagerStatus_UNHEALTHY}
+	cases := []struct {
+		probe Probe
+		conn  ManagerConn
+		pass  bool
+	}{
+		{Probe{Manager: true}, conn, true},
+		{Probe{Manager: true}, sick, false},
+		{Probe{HTTP: healthy.URL}, conn, true},
+		{Probe{HTTP: unhealthy.URL}, conn, false},
+		{Probe{TCP: listener.Addr().String()}, conn, true},
+		{Probe{TCP: closed.Addr().String()}, conn, false},
+	}
+	for _, c := range cases {
+		err := c.probe.check(context.Background(), c.conn)
+		if c.pass && err != nil {
+			t.Errorf("expected %+v to pass, got %v", c.probe, err)
+		}
+		if !c.pass && err == nil {
+			t.Errorf("expected %+v to fail", c.probe)
+		}
+	}
+}
+
+func TestRollOutCommitsPassingConfig(t *testing.T) {
+	conn := &FakeManagerConn{Health: managerPb.ManagerStatus_HEALTHY}
+	canary := &Canary{Probe: Probe{Manager: true}}
+
+	if err := rollOut(context.Background(), conn, []byte(`{"backend":"10.0.0.1"}`), canary); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.Configs) != 1 || conn.Candidate != "" || len(conn.Reverted) != 0 {
+		t.Errorf("expected the candidate to be committed, got configs %v, candidate %q and reverted %v", conn.Configs, conn.Candidate, conn.Reverted)
+	}
+}
+
+func TestRollOutRevertsFailingConfig(t *testing.T) {
+	conn := &FakeManagerConn{Health: managerPb.ManagerStatus_UNHEALTHY}
+	canary := &Canary{Timeout: 50 * time.Millisecond, Probe: Probe{Manager: true}}
+
+	err := rollOut(context.Background(), conn, []byte(`{"backend":"10.0.0.1"}`), canary)
+	if _, rejected := err.(*verificationError); !rejected {
+		t.Fatalf("expected a verification error, got %v", err)
+	}
+	if len(conn.Configs) != 0 || len(conn.Reverted) != 1 {
+		t.Errorf("expected the candidate to be reverted, got configs %v and reverted %v", conn.Configs, conn.Reverted)
+	}
+}
+
+func TestRollOutLargeConfig(t *testing.T) {
+	conn := &FakeManagerConn{Health: managerPb.ManagerStatus_HEALTHY}
+	config := bytes.Repeat([]byte("x"), configStreamThreshold+1)
+
+	if err := rollOut(context.Background(), conn, config, &Canary{Probe: Probe{Manager: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.Configs) != 1 || len(conn.Configs[0]) != len(config) {
+		t.Error("the streamed candidate was not committed")
+	}
+}
+
+func TestRollOutWithoutCanarySupport(t *testing.T) {
+	conn := &FakeManagerConn{NoCanary: true}
+
+	err := rollOut(context.Background(), conn, []byte(`{"backend":"10.0.0.1"}`), &Canary{Probe: Probe{Manager: true}})
+	if err != errNoCanary {
+		t.Errorf("expected errNoCanary, got %v", err)
+	}
+	// An old manager would have applied a candidate right away, it must not have been sent anything
+	if len(conn.Configs) != 0 || conn.Candidate != "" {
+		t.Errorf("the manager was sent a config: %v", conn.Configs)
+	}
+}
+
+const canaryCatalog = `
+lb:
+  image: "quay.io/opencopilot/haproxy-manager"
+  canary:
+    timeout: 50ms
+    probe:
+      manager: true
+`
+
+func TestConfigureServiceWithCanary(t *testing.T) {
+	agent, cleanup := newTestAgent(t, canaryCatalog)
+	defer cleanup()
+	conn, _ := agent.dialer.Dial(agent.provider.Targets["lb"])
+	fake := conn.(*FakeManagerConn)
+	agent.setConfig("lb", "backend", "10.0.0.1")
+
+	agent.syncStore(t)
+	if len(fake.Reverted) != 1 || len(fake.Configs) != 0 {
+		t.Fatalf("expected the unhealthy candidate to be reverted, got configs %v and reverted %v", fake.Configs, fake.Reverted)
+	}
+
+	// A reverted config isn't pushed again until it changes
+	agent.syncStore(t)
+	if len(fake.Reverted) != 1 {
+		t.Errorf("the reverted config was pushed again: %v", fake.Reverted)
+	}
+
+	fake.Health = managerPb.ManagerStatus_HEALTHY
+	agent.setConfig("lb", "backend", "10.0.0.2")
+	agent.syncStore(t)
+	if len(fake.Configs) != 1 || fake.Configs[0] != `{"backend":"10.0.0.2"}` {
+		t.Errorf("expected the new config to be committed, got %v", fake.Configs)
+	}
+}
+
+func TestConfigureServiceWithoutCanarySupport(t *testing.T) {
+	agent, cleanup := newTestAgent(t, canaryCatalog)
+	defer cleanup()
+	conn, _ := agent.dialer.Dial(agent.provider.Targets["lb"])
+	fake := conn.(*FakeManagerConn)
+	fake.NoCanary = true
+	agent.setConfig("lb", "backend", "10.0.0.1")
+
+	agent.syncStore(t)
+
+	if len(fake.Configs) != 1 || fake.Configs[0] != `{"backend":"10.0.0.1"}` {
+		t.Errorf("expected the config to be applied without canary, got %v", fake.Configs)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/docker/go-connections/nat"
+	"gopkg.in/yaml.v2"
+)
+
+// CatalogPath is the catalog of services this agent knows how to run
+var CatalogPath = "./services.yaml"
+
+// CatalogEntry describes how to run a service
+type CatalogEntry struct {
+	// Image is the manager image, ideally a multi-arch manifest list
+	Image string `yaml:"image"`
+	// Platforms overrides Image per architecture, keyed like "amd64", "arm64" or "armv7"
+	Platforms map[string]string `yaml:"platforms"`
+	// Ports are published on the host and opened in the firewall while the service runs, e.g. "80/tcp"
+	Ports []nat.Port `yaml:"ports"`
+	// OpenPorts are only opened in the firewall while the service runs, for the containers the manager starts itself
+	// and which publish them on their own
+	OpenPorts []nat.Port `yaml:"open_ports"`
+	// Hooks are run before the service starts and after it stops
+	Hooks Hooks `yaml:"hooks"`
+	// Quotas limit the storage and bandwidth the service may use
+	Quotas Quotas `yaml:"quotas"`
+	// DependsOn are the services this one relies on, they are drained after it
+	DependsOn []Service `yaml:"depends_on"`
+	// Volumes are named volumes mounted into the manager, kept across container recreation
+	Volumes []*Volume `yaml:"volumes"`
+	// Canary has configs verified by a probe before they are committed, and reverted if they fail it
+	Canary *Canary `yaml:"canary"`
+	// Process runs the manager as a host process when the agent's SERVICE_PROVIDER is process
+	Process *ProcessSpec `yaml:"process"`
+}
+
+// UnmarshalYAML accepts either a full entry or just an image name
+func (entry *CatalogEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var image string
+	if err := unmarshal(&image); err == nil {
+		entry.Image = image
+		return nil
+	}
+
+	type plain CatalogEntry
+	if err := unmarshal((*plain)(entry)); err != nil {
+		return err
+	}
+	if entry.Image == "" && len(entry.Platforms) == 0 && entry.Process == nil {
+		return errors.New("catalog entry has no image or process")
+	}
+	if entry.Process != nil {
+		if err := entry.Process.validate(); err != nil {
+			return err
+		}
+	}
+	for _, ports := range [][]nat.Port{entry.Ports, entry.OpenPorts} {
+		for i, port := range ports {
+			// NewPort validates the port and spells out the default tcp protocol, so "80" becomes "80/tcp"
+			normalized, err := nat.NewPort(port.Proto(), port.Port())
+			if err != nil {
+				return fmt.Errorf("invalid port %q: %v", port, err)
+			}
+			ports[i] = normalized
+		}
+	}
+	if err := entry.Quotas.validate(); err != nil {
+		return err
+	}
+	for _, hook := range append(append([]*Hook{}, entry.Hooks.PreStart...), entry.Hooks.PostStop...) {
+		if err := hook.validate(); err != nil {
+			return err
+		}
+	}
+	if entry.Canary != nil {
+		if err := entry.Canary.validate(); err != nil {
+			return err
+		}
+	}
+	names := map[string]bool{}
+	for _, volume := range entry.Volumes {
+		if err := volume.validate(); err != nil {
+			return err
+		}
+		if names[volume.Name] {
+			return fmt.Errorf("duplicate volume %q", volume.Name)
+		}
+		names[volume.Name] = true
+	}
+	return nil
+}
+
+// ImageFor returns the image to run on platform, preferring a per-architecture override
+func (entry *CatalogEntry) ImageFor(platform Platform) string {
+	if image, found := entry.Platforms[platform.Key()]; found {
+		return image
+	}
+	return entry.Image
+}
+
+// Catalog maps service names to how they are run
+type Catalog map[Service]*CatalogEntry
+
+func loadCatalog(path string) (Catalog, error) {
+	catalogYaml, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	catalog := Catalog{}
+	if err := yaml.Unmarshal(catalogYaml, &catalog); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// portBindings publishes the declared ports on the same host port, and the manager's gRPC port only on the address
+// the agent dials it at, loopback unless the docker daemon is remote
+func (entry *CatalogEntry) portBindings() (nat.PortSet, nat.PortMap) {
+	grpcPort := nat.Port(strconv.Itoa(managerGRPCPort) + "/tcp")
+	exposed := nat.PortSet{grpcPort: struct{}{}}
+	bindings := nat.PortMap{grpcPort: []nat.PortBinding{{HostIP: managerGRPCHost()}}}
+	for _, port := range entry.Ports {
+		exposed[port] = struct{}{}
+		bindings[port] = []nat.PortBinding{{HostPort: port.Port()}}
+	}
+	return exposed, bindings
+}
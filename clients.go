@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	consul "github.com/hashicorp/consul/api"
+	pb "github.com/opencopilot/agent/agent"
+	managerPb "github.com/opencopilot/agent/manager"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// ContainerRuntime is the subset of the Docker API the agent relies on
+type ContainerRuntime interface {
+	ContainerList(ctx context.Context, options dockerTypes.ContainerListOptions) ([]dockerTypes.Container, error)
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error)
+	ContainerStart(ctx context.Context, containerID string, options dockerTypes.ContainerStartOptions) error
+	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
+	ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error)
+	ContainerInspect(ctx context.Context, containerID string) (dockerTypes.ContainerJSON, error)
+	ContainerRemove(ctx context.Context, containerID string, options dockerTypes.ContainerRemoveOptions) error
+	ContainerLogs(ctx context.Context, container string, options dockerTypes.ContainerLogsOptions) (io.ReadCloser, error)
+	CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options dockerTypes.CopyToContainerOptions) error
+	ImagePull(ctx context.Context, refStr string, options dockerTypes.ImagePullOptions) (io.ReadCloser, error)
+	Ping(ctx context.Context) (dockerTypes.Ping, error)
+	Info(ctx context.Context) (dockerTypes.Info, error)
+	DistributionInspect(ctx context.Context, image, encodedRegistryAuth string) (registry.DistributionInspect, error)
+	VolumeCreate(ctx context.Context, options volumetypes.VolumeCreateBody) (dockerTypes.Volume, error)
+	VolumeInspect(ctx context.Context, volumeID string) (dockerTypes.Volume, error)
+	VolumeList(ctx context.Context, filter filters.Args) (volumetypes.VolumeListOKBody, error)
+}
+
+// ConfigStore is the subset of the Consul KV API the agent relies on
+type ConfigStore interface {
+	List(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error)
+	Put(p *consul.KVPair, q *consul.WriteOptions) (*consul.WriteMeta, error)
+	Delete(key string, w *consul.WriteOptions) (*consul.WriteMeta, error)
+}
+
+// ServiceRegistry is the subset of the Consul agent API used to register services
+type ServiceRegistry interface {
+	ServiceRegister(service *consul.AgentServiceRegistration) error
+	ServiceDeregister(serviceID string) error
+	Services() (map[string]*consul.AgentService, error)
+}
+
+// PeerCatalog is the subset of the Consul health API used to find other agents
+type PeerCatalog interface {
+	Service(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error)
+}
+
+// ManagerConn is a connection to the gRPC endpoint of a service manager
+type ManagerConn interface {
+	managerPb.ManagerClient
+	Close() error
+}
+
+// ManagerDialer opens a ManagerConn to the manager listening on target
+type ManagerDialer func(target string) (ManagerConn, error)
+
+type grpcManagerConn struct {
+	managerPb.ManagerClient
+	conn *grpc.ClientConn
+}
+
+func (c *grpcManagerConn) Close() error {
+	return c.conn.Close()
+}
+
+// dialManagerTarget connects to a manager on a unix:// socket or a host:port
+func dialManagerTarget(target string, timeout time.Duration) (net.Conn, error) {
+	if strings.HasPrefix(target, "unix://") {
+		return net.DialTimeout("unix", strings.TrimPrefix(target, "unix://"), timeout)
+	}
+	return net.DialTimeout("tcp", target, timeout)
+}
+
+// newManagerDialer returns the default ManagerDialer, it connects to managers over gRPC
+func newManagerDialer(opts ...grpc.DialOption) ManagerDialer {
+	return func(target string) (ManagerConn, error) {
+		conn, err := grpc.Dial(target, append([]grpc.DialOption{
+			grpc.WithInsecure(),
+			// Connections are long lived, so notice dead managers and retry them without hammering a restarting one.
+			// gRPC servers refuse pings more frequent than every 5 minutes by default.
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: 5 * time.Minute, Timeout: 20 * time.Second}),
+			grpc.WithBackoffMaxDelay(30 * time.Second),
+			grpc.WithDialer(dialManagerTarget),
+		}, opts...)...)
+		if err != nil {
+			return nil, err
+		}
+		return &grpcManagerConn{
+			ManagerClient: managerPb.NewManagerClient(conn),
+			conn:          conn,
+		}, nil
+	}
+}
+
+// PeerConn is a connection to the public gRPC endpoint of another agent
+type PeerConn interface {
+	pb.AgentClient
+	Close() error
+}
+
+// PeerDialer opens a PeerConn to the agent listening on target
+type PeerDialer func(target string) (PeerConn, error)
+
+type grpcPeerConn struct {
+	pb.AgentClient
+	conn *grpc.ClientConn
+}
+
+func (c *grpcPeerConn) Close() error {
+	return c.conn.Close()
+}
+
+// newPeerDialer returns the default PeerDialer, it connects to the public gRPC endpoint of other agents
+func newPeerDialer(opts ...grpc.DialOption) PeerDialer {
+	return func(target string) (PeerConn, error) {
+		// TODO: TLS between agents, like the public endpoint itself
+		conn, err := grpc.Dial(target, append([]grpc.DialOption{grpc.WithInsecure()}, opts...)...)
+		if err != nil {
+			return nil, err
+		}
+		return &grpcPeerConn{
+			AgentClient: pb.NewAgentClient(conn),
+			conn:        conn,
+		}, nil
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	managerPb "github.com/opencopilot/agent/manager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// configStreamThreshold is the config size above which configs are streamed in chunks rather than sent whole
+	configStreamThreshold = 1024 * 1024
+	configChunkSize       = 256 * 1024
+)
+
+// sendConfig sends a config to a manager, streaming large configs in chunks so they stay clear of message size limits.
+// Managers that don't implement ConfigureStream are sent the config whole. A candidate config is sent with
+// ConfigureCandidate instead and only applied tentatively, until it is committed or reverted.
+func sendConfig(ctx context.Context, conn ManagerConn, config []byte, candidate bool) (*managerPb.ManagerStatus, error) {
+	if len(config) > configStreamThreshold {
+		managerStatus, err := streamConfig(ctx, conn, config, candidate)
+		if status.Code(err) != codes.Unimplemented {
+			return managerStatus, err
+		}
+	}
+	request := &managerPb.ConfigureRequest{Config: string(config)}
+	if candidate {
+		return conn.ConfigureCandidate(ctx, request)
+	}
+	return conn.Configure(ctx, request)
+}
+
+// configStream is the client side of ConfigureStream and ConfigureCandidateStream
+type configStream interface {
+	Send(*managerPb.ConfigureChunk) error
+	CloseAndRecv() (*managerPb.ManagerStatus, error)
+}
+
+// streamConfig sends config in chunks, the last one carrying the checksum the manager verifies before applying
+// the config as a whole
+func streamConfig(ctx context.Context, conn ManagerConn, config []byte, candidate bool) (*managerPb.ManagerStatus, error) {
+	var stream configStream
+	var err error
+	if candidate {
+		stream, err = conn.ConfigureCandidateStream(ctx)
+	} else {
+		stream, err = conn.ConfigureStream(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(config)
+	for offset := 0; offset < len(config); offset += configChunkSize {
+		end := offset + configChunkSize
+		if end > len(config) {
+			end = len(config)
+		}
+		chunk := &managerPb.ConfigureChunk{Data: config[offset:end]}
+		if offset == 0 {
+			chunk.TotalSize = uint64(len(config))
+		}
+		if end == len(config) {
+			chunk.Sha256 = hex.EncodeToString(sum[:])
+		}
+		if err := stream.Send(chunk); err != nil {
+			// The real error, e.g. Unimplemented, comes with the response
+			if _, recvErr := stream.CloseAndRecv(); recvErr != nil {
+				return nil, recvErr
+			}
+			return nil, err
+		}
+	}
+	return stream.CloseAndRecv()
+}
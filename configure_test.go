@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	managerPb "github.com/opencopilot/agent/manager"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recordingManagerConn counts the chunks streamed to a FakeManagerConn, or refuses streams if NoStream is set
+type recordingManagerConn struct {
+	*FakeManagerConn
+	NoStream bool
+	Chunks   []*managerPb.ConfigureChunk
+}
+
+func (c *recordingManagerConn) ConfigureStream(ctx context.Context, opts ...grpc.CallOption) (managerPb.Manager_ConfigureStreamClient, error) {
+	if c.NoStream {
+		return nil, status.Error(codes.Unimplemented, "unknown method ConfigureStream")
+	}
+	stream, err := c.FakeManagerConn.ConfigureStream(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConfigureStream{Manager_ConfigureStreamClient: stream, conn: c}, nil
+}
+
+type recordingConfigureStream struct {
+	managerPb.Manager_ConfigureStreamClient
+	conn *recordingManagerConn
+}
+
+func (s *recordingConfigureStream) Send(chunk *managerPb.ConfigureChunk) error {
+	s.conn.Chunks = append(s.conn.Chunks, chunk)
+	return s.Manager_ConfigureStreamClient.Send(chunk)
+}
+
+func TestSendSmallConfig(t *testing.T) {
+	conn := &recordingManagerConn{FakeManagerConn: &FakeManagerConn{}}
+
+	if _, err := sendConfig(context.Background(), conn, []byte(`{"backend":"10.0.0.1"}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.Chunks) != 0 {
+		t.Errorf("expected a small config to be sent whole, got %d chunks", len(conn.Chunks))
+	}
+	if len(conn.Configs) != 1 || conn.Configs[0] != `{"backend":"10.0.0.1"}` {
+		t.Errorf("unexpected configs %v", conn.Configs)
+	}
+}
+
+func TestSendLargeConfig(t *testing.T) {
+	conn := &recordingManagerConn{FakeManagerConn: &FakeManagerConn{}}
+	config := bytes.Repeat([]byte("x"), configStreamThreshold+configChunkSize/2)
+
+	if _, err := sendConfig(context.Background(), conn, config, false); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedChunks := (len(config) + configChunkSize - 1) / configChunkSize
+	if len(conn.Chunks) != expectedChunks {
+		t.Fatalf("expected %d chunks, got %d", expectedChunks, len(conn.Chunks))
+	}
+	if conn.Chunks[0].TotalSize != uint64(len(config)) || conn.Chunks[0].Sha256 != "" {
+		t.Errorf("expected the first chunk to carry the size only, got size %d and sum %q", conn.Chunks[0].TotalSize, conn.Chunks[0].Sha256)
+	}
+	if last := conn.Chunks[len(conn.Chunks)-1]; last.Sha256 == "" || len(last.Data) != configChunkSize/2 {
+		t.Errorf("expected the last chunk to carry the rest of the config and its sum, got %d bytes and sum %q", len(last.Data), last.Sha256)
+	}
+	if len(conn.Configs) != 1 || conn.Configs[0] != string(config) {
+		t.Error("the config was not reassembled")
+	}
+}
+
+func TestSendLargeConfigWithoutStreaming(t *testing.T) {
+	conn := &recordingManagerConn{FakeManagerConn: &FakeManagerConn{}, NoStream: true}
+	config := bytes.Repeat([]byte("x"), configStreamThreshold+1)
+
+	if _, err := sendConfig(context.Background(), conn, config, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.Configs) != 1 || len(conn.Configs[0]) != len(config) {
+		t.Error("the config was not sent whole to a manager without ConfigureStream")
+	}
+}
+
+func TestSendConfigFailure(t *testing.T) {
+	conn := &recordingManagerConn{FakeManagerConn: &FakeManagerConn{ConfigureErr: status.Error(codes.InvalidArgument, "invalid config")}}
+	config := bytes.Repeat([]byte("x"), configStreamThreshold+1)
+
+	// A manager refusing a streamed config isn't sent it again whole
+	if _, err := sendConfig(context.Background(), conn, config, false); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected the manager's error, got %v", err)
+	}
+}
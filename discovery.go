@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	// managerServicePrefix prefixes the Consul service name of every manager, e.g. opencopilot-lb
+	managerServicePrefix = "opencopilot-"
+	// managerMetaService marks a Consul service as a manager registered by this agent
+	managerMetaService = "opencopilot-service"
+	// managerMetaTarget is the gRPC target of a manager, a loopback host:port or a unix socket
+	managerMetaTarget = "grpc-target"
+)
+
+// managerServiceID is the Consul service ID of a manager, unique per instance
+func managerServiceID(service Service) string {
+	return InstanceID + "-" + string(service)
+}
+
+// registerManager registers a running manager as a Consul service, so that "the LB manager on instance X"
+// can be found through the catalog or DNS as X.opencopilot-lb.service.consul. The registration advertises the node's
+// address and the first port the service publishes, the manager's own gRPC target stays in its metadata.
+func (agent *Agent) registerManager(service Service) error {
+	target, err := agent.provider.Target(context.Background(), service)
+	if err != nil {
+		return err
+	}
+
+	ports := []string{}
+	servicePort := 0
+	if catalog, err := loadCatalog(CatalogPath); err == nil {
+		if entry, found := catalog[service]; found {
+			for _, port := range entry.Ports {
+				ports = append(ports, string(port))
+			}
+			if len(entry.Ports) > 0 {
+				servicePort = entry.Ports[0].Int()
+			}
+		}
+	}
+
+	// Address is left empty so that Consul advertises the node's address, the service's ports are published on it
+	registration := &consul.AgentServiceRegistration{
+		ID:   managerServiceID(service),
+		Name: managerServicePrefix + strings.ToLower(string(service)),
+		Tags: []string{InstanceID},
+		Port: servicePort,
+		Meta: map[string]string{
+			managerMetaService: string(service),
+			managerMetaTarget:  target,
+			"instance-id":      InstanceID,
+			"ports":            strings.Join(ports, ","),
+		},
+	}
+
+	if strings.HasPrefix(target, "unix://") {
+		// Consul can't health check a unix socket
+		return agent.registry.ServiceRegister(registration)
+	}
+	// The gRPC endpoint is published where the agent dials it, so the local Consul agent can check it there too
+	registration.Check = &consul.AgentServiceCheck{
+		CheckID:  "manager-grpc-" + managerServiceID(service),
+		Name:     "Manager gRPC Health Check",
+		GRPC:     target,
+		Interval: "10s",
+		// Don't leave registrations behind for managers that vanished while the agent was down
+		DeregisterCriticalServiceAfter: "10m",
+	}
+	return agent.registry.ServiceRegister(registration)
+}
+
+// registerManagers registers every running manager and deregisters those that are no longer running
+func (agent *Agent) registerManagers(services Services) {
+	running := map[string]bool{}
+	for _, service := range services {
+		running[managerServiceID(service)] = true
+		if err := agent.registerManager(service); err != nil {
+			// TODO: do something else here
+			log.Println(err)
+		}
+	}
+
+	registered, err := agent.registry.Services()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for id, registration := range registered {
+		if _, isManager := registration.Meta[managerMetaService]; !isManager || running[id] {
+			continue
+		}
+		if err := agent.registry.ServiceDeregister(id); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// getServiceGRPCTarget looks up the gRPC target of a manager from its Consul registration
+func (agent *Agent) getServiceGRPCTarget(service Service) (string, error) {
+	registered, err := agent.registry.Services()
+	if err != nil {
+		return "", err
+	}
+	registration, found := registered[managerServiceID(service)]
+	if !found {
+		return "", errors.New("service " + string(service) + " is not registered")
+	}
+	target, found := registration.Meta[managerMetaTarget]
+	if !found {
+		return "", errors.New("service " + string(service) + " has no gRPC target")
+	}
+	return target, nil
+}
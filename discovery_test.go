@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestRegisterManager(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.ensureServices(Services{"lb"})
+
+	if err := agent.registerManager("lb"); err != nil {
+		t.Fatal(err)
+	}
+
+	registration, found := agent.registry.Registrations["test-instance-lb"]
+	if !found {
+		t.Fatal("lb was not registered")
+	}
+	if registration.Name != "opencopilot-lb" {
+		t.Errorf("unexpected name %s", registration.Name)
+	}
+	// Consul fills in the node's address, which is where the service's ports are published
+	if registration.Address != "" || registration.Port != 80 {
+		t.Errorf("expected the node's address and port 80, got %q and %d", registration.Address, registration.Port)
+	}
+	if registration.Meta[managerMetaTarget] != "127.0.0.1:50001" || registration.Meta["ports"] != "80/tcp" {
+		t.Errorf("unexpected meta %v", registration.Meta)
+	}
+	if registration.Check == nil || registration.Check.GRPC != "127.0.0.1:50001" {
+		t.Errorf("expected a gRPC check of the loopback target, got %+v", registration.Check)
+	}
+}
+
+func TestRegisterManagerOnUnixSocket(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.provider.Targets["dns"] = "unix:///run/opencopilot/dns.sock"
+	agent.ensureServices(Services{"dns"})
+
+	if err := agent.registerManager("dns"); err != nil {
+		t.Fatal(err)
+	}
+
+	registration := agent.registry.Registrations["test-instance-dns"]
+	if registration.Port != 0 {
+		t.Errorf("expected no port for a service without ports, got %d", registration.Port)
+	}
+	if registration.Check != nil {
+		t.Errorf("expected no check for a unix socket, got %+v", registration.Check)
+	}
+}
+
+func TestRegisterManagersDeregistersStoppedManagers(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	// Services not registered by the agent are left alone
+	agent.registry.ServiceRegister(&consul.AgentServiceRegistration{ID: "consul", Name: "consul"})
+	agent.ensureServices(Services{"lb", "dns"})
+	agent.registerManagers(Services{"lb", "dns"})
+
+	agent.registerManagers(Services{"lb"})
+
+	if _, found := agent.registry.Registrations["test-instance-dns"]; found {
+		t.Error("dns was not deregistered")
+	}
+	for _, id := range []string{"test-instance-lb", "consul"} {
+		if _, found := agent.registry.Registrations[id]; !found {
+			t.Errorf("%s was deregistered", id)
+		}
+	}
+}
+
+func TestGetServiceGRPCTarget(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+
+	if _, err := agent.getServiceGRPCTarget("lb"); err == nil {
+		t.Error("expected an unregistered service to have no target")
+	}
+
+	agent.ensureServices(Services{"lb"})
+	agent.registerManagers(Services{"lb"})
+	target, err := agent.getServiceGRPCTarget("lb")
+	if err != nil || target != "127.0.0.1:50001" {
+		t.Errorf("expected the target of lb, got %q (%v)", target, err)
+	}
+
+	agent.registry.ServiceRegister(&consul.AgentServiceRegistration{ID: "test-instance-dns", Meta: map[string]string{managerMetaService: "dns"}})
+	if _, err := agent.getServiceGRPCTarget("dns"); err == nil {
+		t.Error("expected a registration without a target to fail")
+	}
+}
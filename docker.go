@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+const (
+	dockerAPIVersion   = "1.37"
+	dockerCheckTimeout = 5 * time.Second
+	// Where the docker socket and TLS certificates show up inside manager containers
+	managerDockerSocket   = "/var/run/docker.sock"
+	managerDockerCertPath = "/etc/opencopilot/docker-certs"
+)
+
+// dockerCertFiles are the files expected in DockerCertPath, in the same layout the docker CLI uses
+var dockerCertFiles = []string{"ca.pem", "cert.pem", "key.pem"}
+
+// dockerHost returns the configured DOCKER_HOST, falling back to the local socket
+func dockerHost() string {
+	if DockerHost == "" {
+		return docker.DefaultDockerHost
+	}
+	return DockerHost
+}
+
+// validateDockerConfig checks DOCKER_HOST, DOCKER_CERT_PATH and DOCKER_TLS_VERIFY before any client is built,
+// so a misconfigured device fails at startup rather than on its first reconcile
+func validateDockerConfig() error {
+	host := dockerHost()
+	hostURL, err := docker.ParseHostURL(host)
+	if err != nil {
+		return fmt.Errorf("invalid DOCKER_HOST %q: %v", host, err)
+	}
+
+	switch hostURL.Scheme {
+	case "unix":
+		info, err := os.Stat(hostURL.Host)
+		if err != nil {
+			return fmt.Errorf("invalid DOCKER_HOST %q: %v", host, err)
+		}
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("invalid DOCKER_HOST %q: %s is not a socket", host, hostURL.Host)
+		}
+		if DockerCertPath != "" || DockerTLSVerify {
+			return fmt.Errorf("DOCKER_CERT_PATH and DOCKER_TLS_VERIFY only apply to tcp:// hosts, not %q", host)
+		}
+	case "tcp":
+		if hostURL.Host == "" {
+			return fmt.Errorf("invalid DOCKER_HOST %q: missing address", host)
+		}
+		if net.ParseIP(managerGRPCHost()) == nil {
+			// Managers' gRPC ports are published on this address of the docker host, and docker only binds to IPs
+			return fmt.Errorf("invalid DOCKER_HOST %q: a tcp:// host has to be named by its IP address", host)
+		}
+		if DockerTLSVerify && DockerCertPath == "" {
+			return fmt.Errorf("DOCKER_TLS_VERIFY is set but DOCKER_CERT_PATH is not")
+		}
+		if ConfigDir != "" {
+			log.Printf("warning: CONFIG_DIR %s is bind mounted into managers from the docker host at %s, it has to exist there\n", ConfigDir, host)
+		}
+		if DockerCertPath == "" {
+			log.Printf("warning: connecting to docker at %s without TLS\n", host)
+			return nil
+		}
+		for _, file := range dockerCertFiles {
+			if _, err := os.Stat(filepath.Join(DockerCertPath, file)); err != nil {
+				return fmt.Errorf("invalid DOCKER_CERT_PATH: %v", err)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid DOCKER_HOST %q: unsupported scheme %q, expected unix:// or tcp://", host, hostURL.Scheme)
+	}
+
+	return nil
+}
+
+// remoteDockerDaemon reports whether the configured docker daemon is reached over tcp://, and so may not run on
+// the agent's host
+func remoteDockerDaemon() bool {
+	hostURL, err := docker.ParseHostURL(dockerHost())
+	return err == nil && hostURL.Scheme == "tcp"
+}
+
+// managerGRPCHost is the address managers' gRPC ports are published on and dialed at: loopback for a local daemon,
+// the address DOCKER_HOST names for a tcp:// one, as the agent can't reach the loopback of another host
+func managerGRPCHost() string {
+	if !remoteDockerDaemon() {
+		return "127.0.0.1"
+	}
+	hostURL, _ := docker.ParseHostURL(dockerHost())
+	host, _, err := net.SplitHostPort(hostURL.Host)
+	if err != nil {
+		return strings.Trim(hostURL.Host, "[]")
+	}
+	return host
+}
+
+// newDockerClient builds a docker client for the configured host, it expects validateDockerConfig to have passed
+func newDockerClient() (*docker.Client, error) {
+	opts := []func(*docker.Client) error{}
+	if DockerCertPath != "" {
+		tlsConfig, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             filepath.Join(DockerCertPath, "ca.pem"),
+			CertFile:           filepath.Join(DockerCertPath, "cert.pem"),
+			KeyFile:            filepath.Join(DockerCertPath, "key.pem"),
+			InsecureSkipVerify: !DockerTLSVerify,
+			ExclusiveRootPools: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load docker TLS certificates: %v", err)
+		}
+		// The host has to be applied after the HTTP client, so that it configures this transport
+		opts = append(opts, docker.WithHTTPClient(&http.Client{
+			Transport:     &http.Transport{TLSClientConfig: tlsConfig},
+			CheckRedirect: docker.CheckRedirect,
+		}))
+	}
+	opts = append(opts,
+		docker.WithHost(dockerHost()),
+		docker.WithVersion(dockerAPIVersion),
+	)
+	return docker.NewClientWithOpts(opts...)
+}
+
+// checkDockerConnectivity pings the docker daemon, returning an error naming the host if it can't be reached
+func checkDockerConnectivity(runtime ContainerRuntime) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerCheckTimeout)
+	defer cancel()
+	if _, err := runtime.Ping(ctx); err != nil {
+		return fmt.Errorf("docker daemon at %s is unreachable: %v", dockerHost(), err)
+	}
+	return nil
+}
+
+// managerDockerBinds are the binds that give a manager container access to the same docker daemon as the agent.
+// A tcp:// host needs no binds, its certificates are copied in by copyDockerCerts.
+func managerDockerBinds() []string {
+	hostURL, err := docker.ParseHostURL(dockerHost())
+	if err != nil || hostURL.Scheme != "unix" {
+		return []string{}
+	}
+	return []string{hostURL.Host + ":" + managerDockerSocket}
+}
+
+// copyDockerCerts copies the TLS certificates of a tcp:// host into a created manager container. Bind mounting
+// DockerCertPath would mount it from the docker host, which for a remote daemon isn't where the agent has them.
+func copyDockerCerts(ctx context.Context, runtime ContainerRuntime, containerID string) error {
+	if DockerCertPath == "" {
+		return nil
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	// Docker extracts the archive at /, so the directories leading to managerDockerCertPath are created too
+	dir := ""
+	for _, part := range strings.Split(strings.TrimPrefix(managerDockerCertPath, "/"), "/") {
+		dir += part + "/"
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755}); err != nil {
+			return err
+		}
+	}
+	for _, file := range dockerCertFiles {
+		content, err := ioutil.ReadFile(filepath.Join(DockerCertPath, file))
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: dir + file, Mode: 0400, Size: int64(len(content))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return runtime.CopyToContainer(ctx, containerID, "/", &archive, dockerTypes.CopyToContainerOptions{})
+}
+
+// managerDockerEnv is the environment that points a manager container at the same docker daemon as the agent
+func managerDockerEnv() []string {
+	hostURL, err := docker.ParseHostURL(dockerHost())
+	if err != nil || hostURL.Scheme == "unix" {
+		return []string{}
+	}
+	env := []string{"DOCKER_HOST=" + dockerHost()}
+	if DockerCertPath != "" {
+		env = append(env, "DOCKER_CERT_PATH="+managerDockerCertPath)
+	}
+	if DockerTLSVerify {
+		env = append(env, "DOCKER_TLS_VERIFY=1")
+	}
+	return env
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// withDockerConfig sets the docker globals for a test, the returned func restores them
+func withDockerConfig(host string, certPath string, tlsVerify bool) func() {
+	previousHost, previousCertPath, previousTLSVerify := DockerHost, DockerCertPath, DockerTLSVerify
+	DockerHost, DockerCertPath, DockerTLSVerify = host, certPath, tlsVerify
+	return func() {
+		DockerHost, DockerCertPath, DockerTLSVerify = previousHost, previousCertPath, previousTLSVerify
+	}
+}
+
+// writeDockerCerts writes made up certificates in the layout DOCKER_CERT_PATH expects
+func writeDockerCerts(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "docker-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range dockerCertFiles {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("contents of "+file), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestValidateDockerConfig(t *testing.T) {
+	certPath := writeDockerCerts(t)
+	defer os.RemoveAll(certPath)
+	emptyCertPath, err := ioutil.TempDir("", "docker-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptyCertPath)
+
+	socketDir, err := ioutil.TempDir("", "docker-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(socketDir)
+	socket := filepath.Join(socketDir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	cases := []struct {
+		host      string
+		certPath  string
+		tlsVerify bool
+		valid     bool
+	}{
+		{host: "unix://" + socket, valid: true},
+		{host: "unix://" + filepath.Join(socketDir, "missing.sock")},
+		{host: "unix://" + certPath},
+		{host: "unix://" + socket, certPath: certPath},
+		{host: "tcp://10.0.0.1:2376", valid: true},
+		{host: "tcp://10.0.0.1:2376", certPath: certPath, tlsVerify: true, valid: true},
+		{host: "tcp://10.0.0.1:2376", tlsVerify: true},
+		{host: "tcp://10.0.0.1:2376", certPath: emptyCertPath},
+		{host: "tcp://"},
+		{host: "tcp://docker-vm:2376"},
+		{host: "http://10.0.0.1:2376"},
+		{host: "not a host"},
+	}
+	for _, c := range cases {
+		restore := withDockerConfig(c.host, c.certPath, c.tlsVerify)
+		err := validateDockerConfig()
+		restore()
+		if c.valid && err != nil {
+			t.Errorf("expected %s with cert path %q and verify %v to be valid, got %v", c.host, c.certPath, c.tlsVerify, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("expected %s with cert path %q and verify %v to be invalid", c.host, c.certPath, c.tlsVerify)
+		}
+	}
+}
+
+func TestManagerDockerAccess(t *testing.T) {
+	restore := withDockerConfig("unix:///var/run/docker.sock", "", false)
+	binds, env := managerDockerBinds(), managerDockerEnv()
+	restore()
+	if !reflect.DeepEqual(binds, []string{"/var/run/docker.sock:" + managerDockerSocket}) {
+		t.Errorf("unexpected binds for a unix host: %v", binds)
+	}
+	if len(env) != 0 {
+		t.Errorf("unexpected env for a unix host: %v", env)
+	}
+
+	// The certificates are copied rather than bind mounted, a remote host doesn't have them
+	restore = withDockerConfig("tcp://10.0.0.1:2376", "/etc/docker/certs", true)
+	binds, env = managerDockerBinds(), managerDockerEnv()
+	restore()
+	if len(binds) != 0 {
+		t.Errorf("unexpected binds for a tcp host: %v", binds)
+	}
+	expected := []string{"DOCKER_HOST=tcp://10.0.0.1:2376", "DOCKER_CERT_PATH=" + managerDockerCertPath, "DOCKER_TLS_VERIFY=1"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("unexpected env for a tcp host: %v", env)
+	}
+}
+
+func TestCopyDockerCerts(t *testing.T) {
+	certPath := writeDockerCerts(t)
+	defer os.RemoveAll(certPath)
+	defer withDockerConfig("tcp://10.0.0.1:2376", certPath, true)()
+
+	runtime := NewFakeContainerRuntime()
+	res, err := runtime.ContainerCreate(context.Background(), &container.Config{Image: "manager"}, &container.HostConfig{}, nil, "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := copyDockerCerts(context.Background(), runtime, res.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range dockerCertFiles {
+		copied, found := runtime.Files[res.ID][managerDockerCertPath+"/"+file]
+		if !found {
+			t.Errorf("%s was not copied", file)
+			continue
+		}
+		if copied != "contents of "+file {
+			t.Errorf("%s was copied as %q", file, copied)
+		}
+	}
+}
+
+func TestCopyDockerCertsWithoutCertPath(t *testing.T) {
+	defer withDockerConfig("tcp://10.0.0.1:2376", "", false)()
+
+	runtime := NewFakeContainerRuntime()
+	// Nothing is copied, so the container doesn't even have to exist
+	if err := copyDockerCerts(context.Background(), runtime, "missing"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckDockerConnectivity(t *testing.T) {
+	defer withDockerConfig("tcp://10.0.0.1:2376", "", false)()
+
+	runtime := NewFakeContainerRuntime()
+	if err := checkDockerConnectivity(runtime); err != nil {
+		t.Error(err)
+	}
+
+	runtime.PingErr = errors.New("connection refused")
+	err := checkDockerConnectivity(runtime)
+	if err == nil || !strings.Contains(err.Error(), "tcp://10.0.0.1:2376") {
+		t.Errorf("expected an error naming the host, got %v", err)
+	}
+}
+
+func TestDockerProviderStartCopiesCerts(t *testing.T) {
+	certPath := writeDockerCerts(t)
+	defer os.RemoveAll(certPath)
+	defer withDockerConfig("tcp://10.0.0.1:2376", certPath, true)()
+
+	runtime := NewFakeContainerRuntime()
+	provider := &dockerProvider{runtime: runtime}
+	if err := provider.Start(context.Background(), "lb", &CatalogEntry{Image: "quay.io/opencopilot/haproxy-manager"}); err != nil {
+		t.Fatal(err)
+	}
+
+	containers, err := runtime.ContainerList(context.Background(), dockerTypes.ContainerListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 {
+		t.Fatalf("expected one container, got %d", len(containers))
+	}
+	if _, found := runtime.Files[containers[0].ID][managerDockerCertPath+"/key.pem"]; !found {
+		t.Error("the certificates were not copied into the manager")
+	}
+}
+
+func TestDockerProviderTarget(t *testing.T) {
+	cases := []struct {
+		host string
+		ip   string
+	}{
+		{host: "", ip: "127.0.0.1"},
+		// The agent can't reach the loopback of a remote docker host, the manager is published and dialed on its address
+		{host: "tcp://10.0.0.1:2376", ip: "10.0.0.1"},
+		{host: "tcp://[fd00::1]:2376", ip: "fd00::1"},
+	}
+	for _, c := range cases {
+		restore := withDockerConfig(c.host, "", false)
+		runtime := NewFakeContainerRuntime()
+		provider := &dockerProvider{runtime: runtime}
+		if err := provider.Start(context.Background(), "lb", &CatalogEntry{Image: "quay.io/opencopilot/haproxy-manager"}); err != nil {
+			restore()
+			t.Fatal(err)
+		}
+		target, err := provider.Target(context.Background(), "lb")
+		restore()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		host, _, err := net.SplitHostPort(target)
+		if err != nil || host != c.ip {
+			t.Errorf("expected the manager on %q to be dialed at %s, got %s", c.host, c.ip, target)
+		}
+		containers, _ := runtime.ContainerList(context.Background(), dockerTypes.ContainerListOptions{})
+		for _, port := range containers[0].Ports {
+			if port.PrivatePort == managerGRPCPort && port.IP != c.ip {
+				t.Errorf("expected the gRPC port of the manager on %q to be published on %s, got %s", c.host, c.ip, port.IP)
+			}
+		}
+	}
+}
+
+func TestDockerProviderRefusesEgressQuotaOnRemoteHost(t *testing.T) {
+	defer withDockerConfig("tcp://10.0.0.1:2376", "", false)()
+	runtime := NewFakeContainerRuntime()
+	provider := &dockerProvider{runtime: runtime}
+
+	err := provider.Start(context.Background(), "lb", &CatalogEntry{Image: "quay.io/opencopilot/haproxy-manager", Quotas: Quotas{Egress: "10mbit"}})
+	if err == nil {
+		t.Fatal("expected an egress quota to be refused with a remote docker daemon")
+	}
+	if len(runtime.Containers) != 0 {
+		t.Error("a manager was created anyway")
+	}
+}
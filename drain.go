@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	pb "github.com/opencopilot/agent/agent"
+	managerPb "github.com/opencopilot/agent/manager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+// drainOrder sorts services so that every service comes before the services it depends on, the reverse of the
+// order they would have to start in. Dependencies that aren't running are left out.
+func drainOrder(services Services, catalog Catalog) (Services, error) {
+	running := map[Service]bool{}
+	for _, service := range services {
+		running[service] = true
+	}
+	sorted := append(Services{}, services...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	startOrder := Services{}
+	visited := map[Service]bool{}
+	visiting := map[Service]bool{}
+	var visit func(service Service) error
+	visit = func(service Service) error {
+		if visited[service] {
+			return nil
+		}
+		if visiting[service] {
+			return fmt.Errorf("dependency cycle through service %s", service)
+		}
+		visiting[service] = true
+		if entry, found := catalog[service]; found {
+			for _, dependency := range entry.DependsOn {
+				if !running[dependency] {
+					continue
+				}
+				if err := visit(dependency); err != nil {
+					return err
+				}
+			}
+		}
+		visiting[service] = false
+		visited[service] = true
+		startOrder = append(startOrder, service)
+		return nil
+	}
+	for _, service := range sorted {
+		if err := visit(service); err != nil {
+			return nil, err
+		}
+	}
+
+	order := Services{}
+	for i := len(startOrder) - 1; i >= 0; i-- {
+		order = append(order, startOrder[i])
+	}
+	return order, nil
+}
+
+// drainService asks the manager of service to stop taking new traffic, waiting up to timeout for in-flight traffic
+func (agent *Agent) drainService(ctx context.Context, service Service, timeout time.Duration) error {
+	target, err := agent.getServiceGRPCTarget(service)
+	if err != nil {
+		return err
+	}
+	conn, err := agent.managers.Get(service, target)
+	if err != nil {
+		return err
+	}
+	drainCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err = conn.Drain(drainCtx, &managerPb.ManagerDrainRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return errors.New("manager can't drain, stopping it right away")
+	}
+	return err
+}
+
+// drain stops every local service, dependents first, after giving its manager the chance to drain. Reconciliation
+// is paused first so the services aren't started again, and stays paused until resumed.
+func (agent *Agent) drain(ctx context.Context, timeout time.Duration, deregister bool, progress func(*pb.DrainProgress) error) error {
+	return agent.maintenance.PauseFor("draining", func() error {
+		return agent.drainServices(ctx, timeout, deregister, progress)
+	})
+}
+
+func (agent *Agent) drainServices(ctx context.Context, timeout time.Duration, deregister bool, progress func(*pb.DrainProgress) error) error {
+	localServices, err := agent.getLocalServices()
+	if err != nil {
+		return err
+	}
+	catalog, err := loadCatalog(CatalogPath)
+	if err != nil {
+		return err
+	}
+	order, err := drainOrder(localServices, catalog)
+	if err != nil {
+		return err
+	}
+
+	for _, service := range order {
+		draining := &pb.DrainProgress{Service: string(service), Stage: pb.DrainProgress_DRAINING}
+		if err := agent.drainService(ctx, service, timeout); err != nil {
+			// A manager that can't drain is stopped anyway, the device is going down regardless
+			log.Printf("failed to drain service %s: %v\n", service, err)
+			draining.Error = err.Error()
+		}
+		if err := progress(draining); err != nil {
+			return err
+		}
+
+		stopped := &pb.DrainProgress{Service: string(service), Stage: pb.DrainProgress_STOPPED}
+		if err := agent.stopService(service); err != nil {
+			log.Printf("failed to stop service %s: %v\n", service, err)
+			stopped.Error = err.Error()
+		}
+		if err := progress(stopped); err != nil {
+			return err
+		}
+	}
+
+	if !deregister {
+		return nil
+	}
+	deregistered := &pb.DrainProgress{Stage: pb.DrainProgress_DEREGISTERED}
+	if err := agent.registry.ServiceDeregister(InstanceID); err != nil {
+		deregistered.Error = err.Error()
+	}
+	return progress(deregistered)
+}
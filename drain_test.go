@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	pb "github.com/opencopilot/agent/agent"
+)
+
+func TestDrainOrder(t *testing.T) {
+	catalog := Catalog{
+		"web":   {DependsOn: []Service{"db", "cache"}},
+		"db":    {DependsOn: []Service{"storage"}},
+		"cache": {},
+	}
+
+	// storage isn't running, so it's left out
+	order, err := drainOrder(Services{"cache", "web", "db"}, catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, Services{"web", "db", "cache"}) {
+		t.Errorf("expected dependents to be drained first, got %v", order)
+	}
+
+	catalog["cache"] = &CatalogEntry{DependsOn: []Service{"web"}}
+	if _, err := drainOrder(Services{"cache", "web", "db"}, catalog); err == nil {
+		t.Error("expected a dependency cycle to be refused")
+	}
+}
+
+const drainCatalog = `
+lb:
+  image: "quay.io/opencopilot/haproxy-manager"
+  depends_on: ["dns"]
+dns: "quay.io/opencopilot/dns-manager"
+`
+
+// drainedProgress is a DrainProgress reduced to what the tests compare
+type drainedProgress struct {
+	service string
+	stage   pb.DrainProgress_Stage
+	failed  bool
+}
+
+func TestDrain(t *testing.T) {
+	agent, cleanup := newTestAgent(t, drainCatalog)
+	defer cleanup()
+	agent.maintenance, _ = loadMaintenance("")
+	agent.registry.ServiceRegister(&consul.AgentServiceRegistration{ID: InstanceID, Name: agentServiceName})
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	agent.setConfig("dns", "zone", "example.com")
+	agent.syncStore(t)
+	lb, _ := agent.dialer.Dial(agent.provider.Targets["lb"])
+	dns, _ := agent.dialer.Dial(agent.provider.Targets["dns"])
+	// dns was built before managers could drain
+	dns.(*FakeManagerConn).NoDrain = true
+
+	progress := []drainedProgress{}
+	err := agent.drain(context.Background(), time.Second, true, func(p *pb.DrainProgress) error {
+		progress = append(progress, drainedProgress{p.Service, p.Stage, p.Error != ""})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []drainedProgress{
+		{"lb", pb.DrainProgress_DRAINING, false},
+		{"lb", pb.DrainProgress_STOPPED, false},
+		{"dns", pb.DrainProgress_DRAINING, true},
+		{"dns", pb.DrainProgress_STOPPED, false},
+		{"", pb.DrainProgress_DEREGISTERED, false},
+	}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Errorf("unexpected progress %v", progress)
+	}
+	if !lb.(*FakeManagerConn).Drained {
+		t.Error("lb was not drained")
+	}
+	if agent.running(t, "lb") || agent.running(t, "dns") {
+		t.Error("the services were not stopped")
+	}
+	if _, found := agent.registry.Registrations[InstanceID]; found {
+		t.Error("the agent was not deregistered")
+	}
+
+	// The services stay down until reconciliation is resumed
+	if !agent.maintenance.Paused() {
+		t.Error("expected reconciliation to be paused")
+	}
+}
+
+func TestDrainWithoutDeregister(t *testing.T) {
+	agent, cleanup := newTestAgent(t, drainCatalog)
+	defer cleanup()
+	agent.maintenance, _ = loadMaintenance("")
+	agent.registry.ServiceRegister(&consul.AgentServiceRegistration{ID: InstanceID, Name: agentServiceName})
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	agent.syncStore(t)
+
+	stages := []pb.DrainProgress_Stage{}
+	agent.drain(context.Background(), time.Second, false, func(p *pb.DrainProgress) error {
+		stages = append(stages, p.Stage)
+		return nil
+	})
+
+	if !reflect.DeepEqual(stages, []pb.DrainProgress_Stage{pb.DrainProgress_DRAINING, pb.DrainProgress_STOPPED}) {
+		t.Errorf("unexpected stages %v", stages)
+	}
+	if _, found := agent.registry.Registrations[InstanceID]; !found {
+		t.Error("the agent was deregistered")
+	}
+}
+
+func TestDrainStopsWhenProgressFails(t *testing.T) {
+	agent, cleanup := newTestAgent(t, drainCatalog)
+	defer cleanup()
+	agent.maintenance, _ = loadMaintenance("")
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	agent.setConfig("dns", "zone", "example.com")
+	agent.syncStore(t)
+
+	// The caller went away after the first update
+	err := agent.drain(context.Background(), time.Second, true, func(p *pb.DrainProgress) error {
+		return errors.New("stream closed")
+	})
+	if err == nil {
+		t.Error("expected the failed progress update to be returned")
+	}
+	if !agent.running(t, "lb") || !agent.running(t, "dns") {
+		t.Error("services were stopped after the drain was given up")
+	}
+}
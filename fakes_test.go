@@ -0,0 +1,914 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/go-connections/nat"
+	consul "github.com/hashicorp/consul/api"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	pb "github.com/opencopilot/agent/agent"
+	managerPb "github.com/opencopilot/agent/manager"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	_ ContainerRuntime = &FakeContainerRuntime{}
+	_ ConfigStore      = &FakeConfigStore{}
+	_ ManagerConn      = &FakeManagerConn{}
+	_ ManagerDialer    = (&FakeManagerDialer{}).Dial
+	_ Firewall         = &FakeFirewall{}
+	_ ServiceRegistry  = &FakeServiceRegistry{}
+	_ PeerCatalog      = &FakePeerCatalog{}
+	_ PeerDialer       = (&FakePeerDialer{}).Dial
+	_ PeerConn         = &FakePeerConn{}
+	_ IdentityProvider = &FakeIdentityProvider{}
+	_ ServiceProvider  = &FakeServiceProvider{}
+)
+
+// FakeContainerRuntime is an in-memory ContainerRuntime
+type FakeContainerRuntime struct {
+	mu         sync.Mutex
+	nextID     int
+	nextPort   int
+	Containers map[string]*dockerTypes.Container
+	Pulled     []string
+	Logs       map[string]string
+	PingErr    error
+	// Architecture is what Info reports, x86_64 if unset
+	Architecture string
+	// ExitCodes is the status code containers created from an image exit with once started
+	ExitCodes map[string]int64
+	// Platforms is what DistributionInspect reports for each image, an image that isn't listed has no manifest list
+	Platforms map[string][]specs.Platform
+	// Definitions are the configs containers were created with, keyed by container ID
+	Definitions map[string]*dockerTypes.ContainerJSON
+	Volumes     map[string]*dockerTypes.Volume
+	// Files are the files copied into containers, keyed by container ID and then by path
+	Files map[string]map[string]string
+}
+
+// NewFakeContainerRuntime returns an empty FakeContainerRuntime
+func NewFakeContainerRuntime() *FakeContainerRuntime {
+	return &FakeContainerRuntime{
+		Containers:  map[string]*dockerTypes.Container{},
+		Definitions: map[string]*dockerTypes.ContainerJSON{},
+		Volumes:     map[string]*dockerTypes.Volume{},
+		Files:       map[string]map[string]string{},
+		Logs:        map[string]string{},
+	}
+}
+
+// ContainerList returns the running containers matching the label and name filters in options
+func (f *FakeContainerRuntime) ContainerList(ctx context.Context, options dockerTypes.ContainerListOptions) ([]dockerTypes.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	containers := []dockerTypes.Container{}
+	for _, c := range f.Containers {
+		if c.State != "running" && !options.All {
+			continue
+		}
+		if !fakeMatchesLabels(c, options.Filters.Get("label")) || !fakeMatchesNames(c, options.Filters.Get("name")) {
+			continue
+		}
+		containers = append(containers, *c)
+	}
+	return containers, nil
+}
+
+func fakeMatchesLabels(c *dockerTypes.Container, labels []string) bool {
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		value, found := c.Labels[parts[0]]
+		if !found || (len(parts) == 2 && parts[1] != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func fakeMatchesNames(c *dockerTypes.Container, names []string) bool {
+	for _, name := range names {
+		matched := false
+		for _, containerName := range c.Names {
+			if strings.Contains(containerName, name) {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// ContainerCreate records a new, stopped container
+func (f *FakeContainerRuntime) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range f.Containers {
+		for _, name := range c.Names {
+			if containerName != "" && name == "/"+containerName {
+				return container.ContainerCreateCreatedBody{}, errors.New("container name already in use: " + containerName)
+			}
+		}
+	}
+
+	f.nextID++
+	id := "fake-" + strconv.Itoa(f.nextID)
+	f.Containers[id] = &dockerTypes.Container{
+		ID:     id,
+		Names:  []string{"/" + containerName},
+		Image:  config.Image,
+		Labels: config.Labels,
+		State:  "created",
+	}
+	f.Definitions[id] = &dockerTypes.ContainerJSON{
+		ContainerJSONBase: &dockerTypes.ContainerJSONBase{HostConfig: hostConfig},
+		Config:            config,
+	}
+	return container.ContainerCreateCreatedBody{ID: id}, nil
+}
+
+// ContainerStart marks a container as running
+func (f *FakeContainerRuntime) ContainerStart(ctx context.Context, containerID string, options dockerTypes.ContainerStartOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, found := f.Containers[containerID]
+	if !found {
+		return errors.New("no such container: " + containerID)
+	}
+	c.State = "running"
+	// Publish the bound ports like docker does, picking a host port for bindings without one
+	c.Ports = nil
+	if definition, found := f.Definitions[containerID]; !found || definition.HostConfig == nil {
+		return nil
+	}
+	for port, bindings := range f.Definitions[containerID].HostConfig.PortBindings {
+		for _, binding := range bindings {
+			publicPort, _ := strconv.Atoi(binding.HostPort)
+			if publicPort == 0 {
+				f.nextPort++
+				publicPort = 32767 + f.nextPort
+			}
+			c.Ports = append(c.Ports, dockerTypes.Port{IP: binding.HostIP, PrivatePort: uint16(port.Int()), PublicPort: uint16(publicPort), Type: port.Proto()})
+		}
+	}
+	return nil
+}
+
+// ContainerStop removes a container, mirroring the AutoRemove behavior of managed containers
+func (f *FakeContainerRuntime) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, found := f.Containers[containerID]; !found {
+		return errors.New("no such container: " + containerID)
+	}
+	delete(f.Containers, containerID)
+	delete(f.Definitions, containerID)
+	return nil
+}
+
+// ContainerWait reports the exit code from ExitCodes for the container's image once it is started,
+// or waits for the container to be removed
+func (f *FakeContainerRuntime) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	waitC := make(chan container.ContainerWaitOKBody, 1)
+	errC := make(chan error, 1)
+	go func() {
+		for {
+			f.mu.Lock()
+			c, found := f.Containers[containerID]
+			running := found && c.State == "running"
+			var statusCode int64
+			if found {
+				statusCode = f.ExitCodes[c.Image]
+			}
+			f.mu.Unlock()
+
+			if condition == container.WaitConditionRemoved {
+				if !found {
+					waitC <- container.ContainerWaitOKBody{}
+					return
+				}
+			} else if !found {
+				errC <- errors.New("no such container: " + containerID)
+				return
+			}
+			if running && condition != container.WaitConditionRemoved {
+				waitC <- container.ContainerWaitOKBody{StatusCode: statusCode}
+				return
+			}
+			select {
+			case <-ctx.Done():
+				errC <- ctx.Err()
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	return waitC, errC
+}
+
+// ContainerInspect reports whether a container is running, with a made up pid if it is, and the definition it was created with
+func (f *FakeContainerRuntime) ContainerInspect(ctx context.Context, containerID string) (dockerTypes.ContainerJSON, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, found := f.Containers[containerID]
+	if !found {
+		return dockerTypes.ContainerJSON{}, errors.New("no such container: " + containerID)
+	}
+	state := &dockerTypes.ContainerState{Status: c.State, Running: c.State == "running"}
+	if state.Running {
+		state.Pid = 1000
+	}
+	info := dockerTypes.ContainerJSON{
+		ContainerJSONBase: &dockerTypes.ContainerJSONBase{ID: c.ID, Name: c.Names[0], Image: c.Image, State: state},
+		Config:            &container.Config{Image: c.Image, Labels: c.Labels},
+	}
+	if definition, found := f.Definitions[containerID]; found {
+		info.HostConfig = definition.HostConfig
+		info.Config = definition.Config
+	}
+	return info, nil
+}
+
+// ContainerRemove deletes a container
+func (f *FakeContainerRuntime) ContainerRemove(ctx context.Context, containerID string, options dockerTypes.ContainerRemoveOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, found := f.Containers[containerID]; !found {
+		return errors.New("no such container: " + containerID)
+	}
+	delete(f.Containers, containerID)
+	delete(f.Definitions, containerID)
+	return nil
+}
+
+// ContainerLogs returns the lines stored in Logs for a container
+func (f *FakeContainerRuntime) ContainerLogs(ctx context.Context, containerID string, options dockerTypes.ContainerLogsOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, found := f.Containers[containerID]; !found {
+		return nil, errors.New("no such container: " + containerID)
+	}
+	return ioutil.NopCloser(bytes.NewBufferString(f.Logs[containerID])), nil
+}
+
+// CopyToContainer records the regular files of the tar archive content as extracted at dstPath
+func (f *FakeContainerRuntime) CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options dockerTypes.CopyToContainerOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, found := f.Containers[containerID]; !found {
+		return errors.New("no such container: " + containerID)
+	}
+	if f.Files[containerID] == nil {
+		f.Files[containerID] = map[string]string{}
+	}
+	archive := tar.NewReader(content)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		file, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return err
+		}
+		f.Files[containerID][path.Join(dstPath, header.Name)] = string(file)
+	}
+}
+
+// ImagePull records the pulled image reference
+func (f *FakeContainerRuntime) ImagePull(ctx context.Context, refStr string, options dockerTypes.ImagePullOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Pulled = append(f.Pulled, refStr)
+	return ioutil.NopCloser(&bytes.Buffer{}), nil
+}
+
+// Ping reports a fake daemon, failing with PingErr if set
+func (f *FakeContainerRuntime) Ping(ctx context.Context) (dockerTypes.Ping, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.PingErr != nil {
+		return dockerTypes.Ping{}, f.PingErr
+	}
+	return dockerTypes.Ping{APIVersion: dockerAPIVersion, OSType: "linux"}, nil
+}
+
+// Info reports a linux daemon running on Architecture
+func (f *FakeContainerRuntime) Info(ctx context.Context) (dockerTypes.Info, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	architecture := f.Architecture
+	if architecture == "" {
+		architecture = "x86_64"
+	}
+	return dockerTypes.Info{OSType: "linux", Architecture: architecture}, nil
+}
+
+// DistributionInspect reports the Platforms stored for image
+func (f *FakeContainerRuntime) DistributionInspect(ctx context.Context, image, encodedRegistryAuth string) (registry.DistributionInspect, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return registry.DistributionInspect{Platforms: f.Platforms[image]}, nil
+}
+
+// VolumeCreate records a volume, returning the existing one if there already is a volume of that name
+func (f *FakeContainerRuntime) VolumeCreate(ctx context.Context, options volumetypes.VolumeCreateBody) (dockerTypes.Volume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if volume, found := f.Volumes[options.Name]; found {
+		return *volume, nil
+	}
+	volume := &dockerTypes.Volume{
+		Name:       options.Name,
+		Driver:     "local",
+		Labels:     options.Labels,
+		Options:    options.DriverOpts,
+		Mountpoint: "/var/lib/docker/volumes/" + options.Name + "/_data",
+	}
+	f.Volumes[options.Name] = volume
+	return *volume, nil
+}
+
+// VolumeInspect returns a recorded volume
+func (f *FakeContainerRuntime) VolumeInspect(ctx context.Context, volumeID string) (dockerTypes.Volume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	volume, found := f.Volumes[volumeID]
+	if !found {
+		return dockerTypes.Volume{}, errors.New("no such volume: " + volumeID)
+	}
+	return *volume, nil
+}
+
+// VolumeList returns the recorded volumes matching the label filters
+func (f *FakeContainerRuntime) VolumeList(ctx context.Context, filter filters.Args) (volumetypes.VolumeListOKBody, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	list := volumetypes.VolumeListOKBody{Volumes: []*dockerTypes.Volume{}}
+	for _, volume := range f.Volumes {
+		if fakeMatchesLabels(&dockerTypes.Container{Labels: volume.Labels}, filter.Get("label")) {
+			copied := *volume
+			list.Volumes = append(list.Volumes, &copied)
+		}
+	}
+	return list, nil
+}
+
+// FakeConfigStore is an in-memory ConfigStore
+type FakeConfigStore struct {
+	mu    sync.Mutex
+	index uint64
+	KVs   consul.KVPairs
+}
+
+// Set sets a key, bumping the store index like Consul does on writes
+func (f *FakeConfigStore) Set(key string, value []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.index++
+	for _, kv := range f.KVs {
+		if kv.Key == key {
+			kv.Value = value
+			kv.ModifyIndex = f.index
+			return
+		}
+	}
+	f.KVs = append(f.KVs, &consul.KVPair{Key: key, Value: value, CreateIndex: f.index, ModifyIndex: f.index})
+}
+
+// List returns the pairs under prefix, it never blocks on q.WaitIndex
+func (f *FakeConfigStore) List(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	kvs := consul.KVPairs{}
+	for _, kv := range f.KVs {
+		if strings.HasPrefix(kv.Key, prefix) {
+			pair := *kv
+			kvs = append(kvs, &pair)
+		}
+	}
+	return kvs, &consul.QueryMeta{LastIndex: f.index}, nil
+}
+
+// Put stores a pair
+func (f *FakeConfigStore) Put(p *consul.KVPair, q *consul.WriteOptions) (*consul.WriteMeta, error) {
+	f.Set(p.Key, p.Value)
+	return &consul.WriteMeta{}, nil
+}
+
+// Delete removes a key, bumping the store index if it existed
+func (f *FakeConfigStore) Delete(key string, w *consul.WriteOptions) (*consul.WriteMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, kv := range f.KVs {
+		if kv.Key == key {
+			f.index++
+			f.KVs = append(f.KVs[:i], f.KVs[i+1:]...)
+			break
+		}
+	}
+	return &consul.WriteMeta{}, nil
+}
+
+// FakeServiceRegistry is an in-memory ServiceRegistry
+type FakeServiceRegistry struct {
+	mu            sync.Mutex
+	Registrations map[string]*consul.AgentServiceRegistration
+}
+
+// ServiceRegister records the registration, replacing any with the same ID
+func (f *FakeServiceRegistry) ServiceRegister(service *consul.AgentServiceRegistration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Registrations == nil {
+		f.Registrations = map[string]*consul.AgentServiceRegistration{}
+	}
+	f.Registrations[service.ID] = service
+	return nil
+}
+
+// ServiceDeregister forgets a registration, like Consul it doesn't fail for unknown IDs
+func (f *FakeServiceRegistry) ServiceDeregister(serviceID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.Registrations, serviceID)
+	return nil
+}
+
+// Services returns the registered services
+func (f *FakeServiceRegistry) Services() (map[string]*consul.AgentService, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	services := map[string]*consul.AgentService{}
+	for id, registration := range f.Registrations {
+		services[id] = &consul.AgentService{
+			ID:      registration.ID,
+			Service: registration.Name,
+			Tags:    registration.Tags,
+			Meta:    registration.Meta,
+			Port:    registration.Port,
+			Address: registration.Address,
+		}
+	}
+	return services, nil
+}
+
+// FakeManagerConn is a ManagerConn that records the configs it receives. Candidate configs are only recorded in
+// Configs once committed.
+type FakeManagerConn struct {
+	mu           sync.Mutex
+	Target       string
+	Configs      []string
+	Candidate    string
+	Reverted     []string
+	Health       managerPb.ManagerStatus_Health
+	ConfigureErr error
+	// NoDrain makes the manager one built before Drain existed
+	NoDrain bool
+	// NoCanary makes the manager one built before candidate configs existed
+	NoCanary bool
+	Drained  bool
+	Closed   bool
+}
+
+// GetStatus reports Health
+func (f *FakeManagerConn) GetStatus(ctx context.Context, in *managerPb.ManagerStatusRequest, opts ...grpc.CallOption) (*managerPb.ManagerStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return &managerPb.ManagerStatus{Health: f.Health}, nil
+}
+
+// Commit records the candidate config as applied
+func (f *FakeManagerConn) Commit(ctx context.Context, in *managerPb.CommitRequest, opts ...grpc.CallOption) (*managerPb.ManagerStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Candidate == "" {
+		return nil, status.Error(codes.FailedPrecondition, "no candidate config")
+	}
+	f.Configs = append(f.Configs, f.Candidate)
+	f.Candidate = ""
+	return &managerPb.ManagerStatus{Health: f.Health}, nil
+}
+
+// Revert records the candidate config as reverted
+func (f *FakeManagerConn) Revert(ctx context.Context, in *managerPb.RevertRequest, opts ...grpc.CallOption) (*managerPb.ManagerStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Candidate == "" {
+		return nil, status.Error(codes.FailedPrecondition, "no candidate config")
+	}
+	f.Reverted = append(f.Reverted, f.Candidate)
+	f.Candidate = ""
+	return &managerPb.ManagerStatus{Health: f.Health}, nil
+}
+
+// Configure records the config, failing with ConfigureErr if set
+func (f *FakeManagerConn) Configure(ctx context.Context, in *managerPb.ConfigureRequest, opts ...grpc.CallOption) (*managerPb.ManagerStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.ConfigureErr != nil {
+		return nil, f.ConfigureErr
+	}
+	f.Configs = append(f.Configs, in.Config)
+	return &managerPb.ManagerStatus{}, nil
+}
+
+// ConfigureCandidate records the candidate config, failing with ConfigureErr if set or with Unimplemented if
+// NoCanary is set
+func (f *FakeManagerConn) ConfigureCandidate(ctx context.Context, in *managerPb.ConfigureRequest, opts ...grpc.CallOption) (*managerPb.ManagerStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.NoCanary {
+		return nil, status.Error(codes.Unimplemented, "unknown method ConfigureCandidate")
+	}
+	if f.ConfigureErr != nil {
+		return nil, f.ConfigureErr
+	}
+	f.Candidate = in.Config
+	return &managerPb.ManagerStatus{}, nil
+}
+
+// Drain records that the manager was drained, or fails with Unimplemented if NoDrain is set
+func (f *FakeManagerConn) Drain(ctx context.Context, in *managerPb.ManagerDrainRequest, opts ...grpc.CallOption) (*managerPb.ManagerStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.NoDrain {
+		return nil, status.Error(codes.Unimplemented, "unknown method Drain")
+	}
+	f.Drained = true
+	return &managerPb.ManagerStatus{Health: f.Health}, nil
+}
+
+// ConfigureStream collects chunks, recording the config once the stream is closed and its checksum matches
+func (f *FakeManagerConn) ConfigureStream(ctx context.Context, opts ...grpc.CallOption) (managerPb.Manager_ConfigureStreamClient, error) {
+	return &fakeConfigureStream{ctx: ctx, conn: f}, nil
+}
+
+// ConfigureCandidateStream is ConfigureStream for candidate configs
+func (f *FakeManagerConn) ConfigureCandidateStream(ctx context.Context, opts ...grpc.CallOption) (managerPb.Manager_ConfigureCandidateStreamClient, error) {
+	return &fakeConfigureStream{ctx: ctx, conn: f, candidate: true}, nil
+}
+
+type fakeConfigureStream struct {
+	grpc.ClientStream
+	ctx       context.Context
+	conn      *FakeManagerConn
+	config    bytes.Buffer
+	sum       string
+	candidate bool
+}
+
+func (s *fakeConfigureStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeConfigureStream) Send(chunk *managerPb.ConfigureChunk) error {
+	s.config.Write(chunk.Data)
+	if chunk.Sha256 != "" {
+		s.sum = chunk.Sha256
+	}
+	return nil
+}
+
+func (s *fakeConfigureStream) CloseAndRecv() (*managerPb.ManagerStatus, error) {
+	sum := sha256.Sum256(s.config.Bytes())
+	if hex.EncodeToString(sum[:]) != s.sum {
+		return nil, status.Error(codes.DataLoss, "config checksum mismatch")
+	}
+	request := &managerPb.ConfigureRequest{Config: s.config.String()}
+	if s.candidate {
+		return s.conn.ConfigureCandidate(s.ctx, request)
+	}
+	return s.conn.Configure(s.ctx, request)
+}
+
+// Close marks the connection as closed
+func (f *FakeManagerConn) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Closed = true
+	return nil
+}
+
+// FakeManagerDialer hands out one FakeManagerConn per target
+type FakeManagerDialer struct {
+	mu    sync.Mutex
+	Conns map[string]*FakeManagerConn
+}
+
+// Dial is a ManagerDialer returning the FakeManagerConn for target
+func (f *FakeManagerDialer) Dial(target string) (ManagerConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Conns == nil {
+		f.Conns = map[string]*FakeManagerConn{}
+	}
+	conn, found := f.Conns[target]
+	if !found {
+		conn = &FakeManagerConn{Target: target}
+		f.Conns[target] = conn
+	}
+	return conn, nil
+}
+
+// FakeFirewall records the ports it was last asked to open
+type FakeFirewall struct {
+	mu   sync.Mutex
+	Open []nat.Port
+}
+
+// Sync records ports as the open ports
+func (f *FakeFirewall) Sync(ports []nat.Port) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Open = append([]nat.Port{}, ports...)
+	return nil
+}
+
+// FakePeerCatalog is a PeerCatalog over a fixed list of service entries, all of them passing
+type FakePeerCatalog struct {
+	Entries []*consul.ServiceEntry
+}
+
+// Service returns the entries of service carrying tag
+func (f *FakePeerCatalog) Service(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	entries := []*consul.ServiceEntry{}
+	for _, entry := range f.Entries {
+		if entry.Service.Service != service {
+			continue
+		}
+		tagged := tag == ""
+		for _, t := range entry.Service.Tags {
+			if t == tag {
+				tagged = true
+			}
+		}
+		if tagged {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, &consul.QueryMeta{}, nil
+}
+
+// FakePeerDialer hands out the PeerConn set up for each target
+type FakePeerDialer struct {
+	Conns map[string]PeerConn
+}
+
+// Dial is a PeerDialer returning the PeerConn for target
+func (f *FakePeerDialer) Dial(target string) (PeerConn, error) {
+	conn, found := f.Conns[target]
+	if !found {
+		return nil, errors.New("no peer at " + target)
+	}
+	return conn, nil
+}
+
+// FakePeerConn is another agent answering GetStatus and GetServiceLogs, its other calls are unimplemented
+type FakePeerConn struct {
+	mu     sync.Mutex
+	Status *pb.AgentStatus
+	// Logs are the lines GetServiceLogs streams for any service
+	Logs   []string
+	Err    error
+	Closed bool
+}
+
+// GetStatus returns Status, or Err if set
+func (f *FakePeerConn) GetStatus(ctx context.Context, in *pb.AgentStatusRequest, opts ...grpc.CallOption) (*pb.AgentStatus, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.Status, nil
+}
+
+// GetServiceLogs streams Logs, or fails with Err if set
+func (f *FakePeerConn) GetServiceLogs(ctx context.Context, in *pb.GetServiceLogsRequest, opts ...grpc.CallOption) (pb.Agent_GetServiceLogsClient, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return &fakeLogsClient{lines: append([]string{}, f.Logs...)}, nil
+}
+
+// CheckRuntime is unimplemented
+func (f *FakePeerConn) CheckRuntime(ctx context.Context, in *pb.RuntimeCheckRequest, opts ...grpc.CallOption) (*pb.RuntimeCheck, error) {
+	return nil, status.Error(codes.Unimplemented, "unknown method CheckRuntime")
+}
+
+// GetSiteStatus is unimplemented
+func (f *FakePeerConn) GetSiteStatus(ctx context.Context, in *pb.SiteStatusRequest, opts ...grpc.CallOption) (*pb.SiteStatus, error) {
+	return nil, status.Error(codes.Unimplemented, "unknown method GetSiteStatus")
+}
+
+// PauseReconciliation is unimplemented
+func (f *FakePeerConn) PauseReconciliation(ctx context.Context, in *pb.PauseReconciliationRequest, opts ...grpc.CallOption) (*pb.ReconciliationState, error) {
+	return nil, status.Error(codes.Unimplemented, "unknown method PauseReconciliation")
+}
+
+// ResumeReconciliation is unimplemented
+func (f *FakePeerConn) ResumeReconciliation(ctx context.Context, in *pb.ResumeReconciliationRequest, opts ...grpc.CallOption) (*pb.ReconciliationState, error) {
+	return nil, status.Error(codes.Unimplemented, "unknown method ResumeReconciliation")
+}
+
+// Drain is unimplemented
+func (f *FakePeerConn) Drain(ctx context.Context, in *pb.DrainRequest, opts ...grpc.CallOption) (pb.Agent_DrainClient, error) {
+	return nil, status.Error(codes.Unimplemented, "unknown method Drain")
+}
+
+// ListVolumes is unimplemented
+func (f *FakePeerConn) ListVolumes(ctx context.Context, in *pb.ListVolumesRequest, opts ...grpc.CallOption) (*pb.VolumeList, error) {
+	return nil, status.Error(codes.Unimplemented, "unknown method ListVolumes")
+}
+
+// Close marks the connection as closed
+func (f *FakePeerConn) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Closed = true
+	return nil
+}
+
+type fakeLogsClient struct {
+	grpc.ClientStream
+	lines []string
+}
+
+func (c *fakeLogsClient) Recv() (*pb.ServiceLogLine, error) {
+	if len(c.lines) == 0 {
+		return nil, io.EOF
+	}
+	line := c.lines[0]
+	c.lines = c.lines[1:]
+	return &pb.ServiceLogLine{Line: line}, nil
+}
+
+// FakeLogsServer collects the log lines sent to it
+type FakeLogsServer struct {
+	grpc.ServerStream
+	Ctx   context.Context
+	Lines []string
+}
+
+// Context returns Ctx
+func (s *FakeLogsServer) Context() context.Context {
+	return s.Ctx
+}
+
+// Send records line
+func (s *FakeLogsServer) Send(line *pb.ServiceLogLine) error {
+	s.Lines = append(s.Lines, line.Line)
+	return nil
+}
+
+// FakeIdentityProvider hands out a fixed identity document
+type FakeIdentityProvider struct {
+	Identity *IdentityDocument
+	Err      error
+	// Fetches counts the calls to Fetch
+	Fetches int
+}
+
+// Fetch returns a copy of Identity for nonce, or Err if set
+func (f *FakeIdentityProvider) Fetch(ctx context.Context, nonce string) (*IdentityDocument, error) {
+	f.Fetches++
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	identity := *f.Identity
+	identity.Nonce = nonce
+	return &identity, nil
+}
+
+// FakeServiceProvider runs services in name only, each one reachable on the target it was given in Targets
+type FakeServiceProvider struct {
+	mu       sync.Mutex
+	Services map[Service]*CatalogEntry
+	Targets  map[Service]string
+	StartErr error
+}
+
+// Start records service as running, failing with StartErr if set
+func (f *FakeServiceProvider) Start(ctx context.Context, service Service, entry *CatalogEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.StartErr != nil {
+		return f.StartErr
+	}
+	if f.Services == nil {
+		f.Services = map[Service]*CatalogEntry{}
+	}
+	f.Services[service] = entry
+	return nil
+}
+
+// Stop forgets service
+func (f *FakeServiceProvider) Stop(ctx context.Context, service Service) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.Services, service)
+	return nil
+}
+
+// Running lists the started services
+func (f *FakeServiceProvider) Running(ctx context.Context) (Services, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	running := Services{}
+	for service := range f.Services {
+		running = append(running, service)
+	}
+	return running, nil
+}
+
+// Drift reports the whole definition as drifted if entry differs from the entry service was started with
+func (f *FakeServiceProvider) Drift(ctx context.Context, service Service, entry *CatalogEntry) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	started, running := f.Services[service]
+	if !running {
+		return nil, errors.New("service " + string(service) + " is not running")
+	}
+	if !reflect.DeepEqual(started, entry) {
+		return []string{"definition"}, nil
+	}
+	return []string{}, nil
+}
+
+// Target returns the target of service from Targets
+func (f *FakeServiceProvider) Target(ctx context.Context, service Service) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, running := f.Services[service]; !running {
+		return "", errors.New("service " + string(service) + " is not running")
+	}
+	target, found := f.Targets[service]
+	if !found {
+		return "", errors.New("no target for service " + string(service))
+	}
+	return target, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	pb "github.com/opencopilot/agent/agent"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// agentServiceName is the Consul service every agent registers itself as
+	agentServiceName = "opencopilot-agent"
+	peerCallTimeout  = 5 * time.Second
+)
+
+// Peer is an agent registered in Consul
+type Peer struct {
+	InstanceID string
+	Site       string
+	Address    string
+}
+
+// Federation lets agents at the same site find each other, so a single agent can answer for the whole site
+// and forward calls meant for another instance to it
+type Federation struct {
+	health   PeerCatalog
+	dialPeer PeerDialer
+}
+
+func peerFromEntry(entry *consul.ServiceEntry) *Peer {
+	address := entry.Service.Address
+	if address == "" {
+		address = entry.Node.Address
+	}
+	return &Peer{
+		InstanceID: entry.Service.ID,
+		Site:       entry.Service.Meta["site"],
+		Address:    address + ":" + strconv.Itoa(entry.Service.Port),
+	}
+}
+
+// newFederation returns the Federation of agents registered in Consul, or nil if no site is configured
+func newFederation(site string, health PeerCatalog, dialPeer PeerDialer) *Federation {
+	if site == "" {
+		return nil
+	}
+	return &Federation{health: health, dialPeer: dialPeer}
+}
+
+// peers lists the healthy agents at site, including this one
+func (f *Federation) peers(site string) ([]*Peer, error) {
+	entries, _, err := f.health.Service(agentServiceName, site, true, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []*Peer{}
+	for _, entry := range entries {
+		peers = append(peers, peerFromEntry(entry))
+	}
+	return peers, nil
+}
+
+// peer finds the agent of an instance anywhere in the federation
+func (f *Federation) peer(instanceID string) (*Peer, error) {
+	entries, _, err := f.health.Service(agentServiceName, "", true, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Service.ID != instanceID {
+			continue
+		}
+		return peerFromEntry(entry), nil
+	}
+	return nil, status.Errorf(codes.NotFound, "no healthy agent for instance %s", instanceID)
+}
+
+// forwardGetStatus asks the agent of in.InstanceId for its status
+func (f *Federation) forwardGetStatus(ctx context.Context, in *pb.AgentStatusRequest) (*pb.AgentStatus, error) {
+	peer, err := f.peer(in.InstanceId)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := f.dialPeer(peer.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.GetStatus(ctx, in)
+}
+
+// forwardGetServiceLogs relays the log lines of a service running on the agent of in.InstanceId
+func (f *Federation) forwardGetServiceLogs(in *pb.GetServiceLogsRequest, stream pb.Agent_GetServiceLogsServer) error {
+	peer, err := f.peer(in.InstanceId)
+	if err != nil {
+		return err
+	}
+	conn, err := f.dialPeer(peer.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lines, err := conn.GetServiceLogs(stream.Context(), in)
+	if err != nil {
+		return err
+	}
+	for {
+		line, err := lines.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(line); err != nil {
+			return err
+		}
+	}
+}
+
+// siteStatus collects the status of every agent at site, local is used for this agent instead of a call to itself
+func (f *Federation) siteStatus(ctx context.Context, site string, local func(context.Context) (*pb.AgentStatus, error)) (*pb.SiteStatus, error) {
+	peers, err := f.peers(site)
+	if err != nil {
+		return nil, err
+	}
+
+	siteStatus := &pb.SiteStatus{SiteId: site, Agents: []*pb.AgentStatus{}, Unreachable: []string{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer *Peer) {
+			defer wg.Done()
+			peerCtx, cancel := context.WithTimeout(ctx, peerCallTimeout)
+			defer cancel()
+
+			var agentStatus *pb.AgentStatus
+			var err error
+			if peer.InstanceID == InstanceID {
+				agentStatus, err = local(peerCtx)
+			} else {
+				agentStatus, err = f.peerStatus(peerCtx, peer)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("failed to get status of peer %s: %v\n", peer.InstanceID, err)
+				siteStatus.Unreachable = append(siteStatus.Unreachable, peer.InstanceID)
+				return
+			}
+			siteStatus.Agents = append(siteStatus.Agents, agentStatus)
+		}(peer)
+	}
+	wg.Wait()
+
+	return siteStatus, nil
+}
+
+func (f *Federation) peerStatus(ctx context.Context, peer *Peer) (*pb.AgentStatus, error) {
+	conn, err := f.dialPeer(peer.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.GetStatus(ctx, &pb.AgentStatusRequest{InstanceId: peer.InstanceID})
+}
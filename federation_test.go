@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	pb "github.com/opencopilot/agent/agent"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// agentEntry is the Consul registration of the agent of instanceID at site
+func agentEntry(instanceID string, site string, address string) *consul.ServiceEntry {
+	return &consul.ServiceEntry{
+		Node: &consul.Node{Address: "10.0.0.100"},
+		Service: &consul.AgentService{
+			ID:      instanceID,
+			Service: agentServiceName,
+			Tags:    []string{site},
+			Meta:    map[string]string{"site": site},
+			Address: address,
+			Port:    50051,
+		},
+	}
+}
+
+func newTestFederation(conns map[string]PeerConn) *Federation {
+	catalog := &FakePeerCatalog{Entries: []*consul.ServiceEntry{
+		agentEntry("test-instance", "ams1", "10.0.0.1"),
+		agentEntry("peer-1", "ams1", "10.0.0.2"),
+		agentEntry("peer-2", "ams1", ""),
+		agentEntry("peer-3", "fra1", "10.1.0.1"),
+	}}
+	return newFederation("ams1", catalog, (&FakePeerDialer{Conns: conns}).Dial)
+}
+
+func TestNewFederation(t *testing.T) {
+	if federation := newFederation("", &FakePeerCatalog{}, nil); federation != nil {
+		t.Error("expected no federation without a site")
+	}
+}
+
+func TestFederationPeers(t *testing.T) {
+	federation := newTestFederation(nil)
+
+	peers, err := federation.peers("ams1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := map[string]string{}
+	for _, peer := range peers {
+		addresses[peer.InstanceID] = peer.Address
+	}
+	// An agent registered without an address is reached on its node's
+	expected := map[string]string{"test-instance": "10.0.0.1:50051", "peer-1": "10.0.0.2:50051", "peer-2": "10.0.0.100:50051"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("unexpected peers %v", addresses)
+	}
+
+	peer, err := federation.peer("peer-3")
+	if err != nil || peer.Site != "fra1" {
+		t.Errorf("expected peer-3 at fra1, got %+v (%v)", peer, err)
+	}
+	if _, err := federation.peer("missing"); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for an unknown instance, got %v", err)
+	}
+}
+
+func TestFederationForwardGetStatus(t *testing.T) {
+	conn := &FakePeerConn{Status: &pb.AgentStatus{InstanceId: "peer-3"}}
+	federation := newTestFederation(map[string]PeerConn{"10.1.0.1:50051": conn})
+
+	agentStatus, err := federation.forwardGetStatus(context.Background(), &pb.AgentStatusRequest{InstanceId: "peer-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agentStatus.InstanceId != "peer-3" {
+		t.Errorf("unexpected status %+v", agentStatus)
+	}
+	if !conn.Closed {
+		t.Error("the peer connection was left open")
+	}
+}
+
+func TestFederationForwardGetServiceLogs(t *testing.T) {
+	conn := &FakePeerConn{Logs: []string{"starting", "listening on :80"}}
+	federation := newTestFederation(map[string]PeerConn{"10.0.0.2:50051": conn})
+
+	stream := &FakeLogsServer{Ctx: context.Background()}
+	if err := federation.forwardGetServiceLogs(&pb.GetServiceLogsRequest{InstanceId: "peer-1", ContainerId: "lb"}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stream.Lines, conn.Logs) {
+		t.Errorf("unexpected lines %v", stream.Lines)
+	}
+}
+
+func TestFederationSiteStatus(t *testing.T) {
+	previousInstanceID := InstanceID
+	InstanceID = "test-instance"
+	defer func() { InstanceID = previousInstanceID }()
+
+	federation := newTestFederation(map[string]PeerConn{
+		"10.0.0.2:50051":   &FakePeerConn{Status: &pb.AgentStatus{InstanceId: "peer-1"}},
+		"10.0.0.100:50051": &FakePeerConn{Err: errors.New("connection refused")},
+	})
+	local := func(ctx context.Context) (*pb.AgentStatus, error) {
+		return &pb.AgentStatus{InstanceId: "test-instance"}, nil
+	}
+
+	siteStatus, err := federation.siteStatus(context.Background(), "ams1", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reached := []string{}
+	for _, agentStatus := range siteStatus.Agents {
+		reached = append(reached, agentStatus.InstanceId)
+	}
+	sort.Strings(reached)
+	if !reflect.DeepEqual(reached, []string{"peer-1", "test-instance"}) {
+		t.Errorf("unexpected agents %v", reached)
+	}
+	if !reflect.DeepEqual(siteStatus.Unreachable, []string{"peer-2"}) {
+		t.Errorf("unexpected unreachable agents %v", siteStatus.Unreachable)
+	}
+}
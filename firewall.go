@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+)
+
+const firewallChain = "OPENCOPILOT"
+
+// Firewall restricts which published service ports are reachable from the public interface
+type Firewall interface {
+	// Sync makes ports the only published ports reachable, closing any that were opened before
+	Sync(ports []nat.Port) error
+}
+
+// newFirewall returns the firewall backend named by kind, or nil if the firewall is disabled
+func newFirewall(kind string, iface string) (Firewall, error) {
+	if kind == "" {
+		return nil, nil
+	}
+	if iface == "" {
+		return nil, fmt.Errorf("FIREWALL_INTERFACE is required when FIREWALL is set")
+	}
+	switch kind {
+	case "iptables":
+		return &iptablesFirewall{iface: iface}, nil
+	case "nftables":
+		return &nftablesFirewall{iface: iface}, nil
+	default:
+		return nil, fmt.Errorf("unsupported FIREWALL %q, expected iptables or nftables", kind)
+	}
+}
+
+// runCommand runs a command on the host, returning its output as part of the error if it fails
+func runCommand(stdin string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// sortedPorts returns ports in a stable order so rulesets don't churn between syncs
+func sortedPorts(ports []nat.Port) []nat.Port {
+	sorted := append([]nat.Port{}, ports...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Proto() != sorted[j].Proto() {
+			return sorted[i].Proto() < sorted[j].Proto()
+		}
+		return sorted[i].Int() < sorted[j].Int()
+	})
+	return sorted
+}
+
+// iptablesFirewall filters docker-published traffic through the DOCKER-USER chain, which docker leaves to the host
+type iptablesFirewall struct {
+	iface string
+}
+
+func (f *iptablesFirewall) Sync(ports []nat.Port) error {
+	// Declaring the chain in iptables-restore flushes it, so the new rules replace the old ones atomically
+	rules := []string{"*filter", ":" + firewallChain + " - [0:0]"}
+	rules = append(rules, "-A "+firewallChain+" -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN")
+	for _, port := range sortedPorts(ports) {
+		rules = append(rules, fmt.Sprintf("-A %s -p %s -m %s --dport %d -j RETURN", firewallChain, port.Proto(), port.Proto(), port.Int()))
+	}
+	// Only traffic docker forwarded to a published port is dropped, everything else is left to the host's own rules
+	rules = append(rules, "-A "+firewallChain+" -m conntrack --ctstate DNAT -j DROP", "COMMIT", "")
+	if err := runCommand(strings.Join(rules, "\n"), "iptables-restore", "--noflush"); err != nil {
+		return err
+	}
+
+	jump := []string{"DOCKER-USER", "-i", f.iface, "-j", firewallChain}
+	if err := runCommand("", "iptables", append([]string{"-C"}, jump...)...); err == nil {
+		return nil
+	}
+	return runCommand("", "iptables", append([]string{"-I"}, jump...)...)
+}
+
+// nftablesFirewall keeps its rules in a table of its own, replaced atomically on every sync
+type nftablesFirewall struct {
+	iface string
+}
+
+func (f *nftablesFirewall) Sync(ports []nat.Port) error {
+	byProto := map[string][]string{}
+	for _, port := range sortedPorts(ports) {
+		byProto[port.Proto()] = append(byProto[port.Proto()], port.Port())
+	}
+
+	// Creating the table before deleting it makes the delete safe on the first sync
+	rules := []string{
+		"table inet opencopilot",
+		"delete table inet opencopilot",
+		"table inet opencopilot {",
+		"\tchain forward {",
+		"\t\ttype filter hook forward priority -1; policy accept;",
+		fmt.Sprintf("\t\tiifname %q ct state established,related accept", f.iface),
+	}
+	for _, proto := range []string{"tcp", "udp", "sctp"} {
+		if len(byProto[proto]) == 0 {
+			continue
+		}
+		rules = append(rules, fmt.Sprintf("\t\tiifname %q %s dport { %s } accept", f.iface, proto, strings.Join(byProto[proto], ", ")))
+	}
+	rules = append(rules,
+		fmt.Sprintf("\t\tiifname %q ct status dnat drop", f.iface),
+		"\t}",
+		"}",
+		"",
+	)
+	return runCommand(strings.Join(rules, "\n"), "nft", "-f", "-")
+}
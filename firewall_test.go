@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"gopkg.in/yaml.v2"
+)
+
+// withFakeCommands puts scripts named after commands first on PATH, each appending its arguments and stdin to
+// <name>.log in the returned directory and then running the given shell line to exit
+func withFakeCommands(t *testing.T, exits map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "fake-commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, exit := range exits {
+		log := filepath.Join(dir, name+".log")
+		script := "#!/bin/sh\necho \"$@\" >> " + log + "\ncat >> " + log + "\n" + exit + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return dir, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func readCommandLog(t *testing.T, dir string, name string) string {
+	log, err := ioutil.ReadFile(filepath.Join(dir, name+".log"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(log)
+}
+
+func TestNewFirewall(t *testing.T) {
+	if firewall, err := newFirewall("", ""); firewall != nil || err != nil {
+		t.Errorf("expected no firewall, got %v (%v)", firewall, err)
+	}
+	if _, err := newFirewall("iptables", ""); err == nil {
+		t.Error("expected a firewall without an interface to be refused")
+	}
+	if _, err := newFirewall("pf", "eth0"); err == nil {
+		t.Error("expected pf to be unsupported")
+	}
+	if firewall, err := newFirewall("nftables", "eth0"); err != nil || firewall.(*nftablesFirewall).iface != "eth0" {
+		t.Errorf("unexpected nftables firewall %v (%v)", firewall, err)
+	}
+}
+
+func TestSortedPorts(t *testing.T) {
+	sorted := sortedPorts([]nat.Port{"443/tcp", "53/udp", "80/tcp"})
+	if !reflect.DeepEqual(sorted, []nat.Port{"80/tcp", "443/tcp", "53/udp"}) {
+		t.Errorf("unexpected order %v", sorted)
+	}
+}
+
+func TestIptablesFirewallSync(t *testing.T) {
+	dir, restore := withFakeCommands(t, map[string]string{"iptables-restore": "exit 0", "iptables": `[ "$1" != -C ]`})
+	defer restore()
+
+	firewall := &iptablesFirewall{iface: "eth0"}
+	if err := firewall.Sync([]nat.Port{"443/tcp", "80/tcp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := readCommandLog(t, dir, "iptables-restore")
+	expected := strings.Join([]string{
+		"--noflush",
+		"*filter",
+		":OPENCOPILOT - [0:0]",
+		"-A OPENCOPILOT -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN",
+		"-A OPENCOPILOT -p tcp -m tcp --dport 80 -j RETURN",
+		"-A OPENCOPILOT -p tcp -m tcp --dport 443 -j RETURN",
+		"-A OPENCOPILOT -m conntrack --ctstate DNAT -j DROP",
+		"COMMIT",
+		"",
+	}, "\n")
+	if rules != expected {
+		t.Errorf("unexpected rules:\n%s", rules)
+	}
+	// The jump isn't there yet, so it is inserted after being checked for
+	if jumps := readCommandLog(t, dir, "iptables"); !strings.Contains(jumps, "-I DOCKER-USER -i eth0 -j OPENCOPILOT") {
+		t.Errorf("the jump to the chain was not inserted: %s", jumps)
+	}
+}
+
+func TestIptablesFirewallSyncFailure(t *testing.T) {
+	_, restore := withFakeCommands(t, map[string]string{"iptables-restore": "exit 1", "iptables": "exit 0"})
+	defer restore()
+
+	firewall := &iptablesFirewall{iface: "eth0"}
+	if err := firewall.Sync([]nat.Port{"80/tcp"}); err == nil || !strings.Contains(err.Error(), "iptables-restore") {
+		t.Errorf("expected the failing command to be named, got %v", err)
+	}
+}
+
+func TestNftablesFirewallSync(t *testing.T) {
+	dir, restore := withFakeCommands(t, map[string]string{"nft": "exit 0"})
+	defer restore()
+
+	firewall := &nftablesFirewall{iface: "eth0"}
+	if err := firewall.Sync([]nat.Port{"443/tcp", "53/udp", "80/tcp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := readCommandLog(t, dir, "nft")
+	for _, rule := range []string{
+		`iifname "eth0" tcp dport { 80, 443 } accept`,
+		`iifname "eth0" udp dport { 53 } accept`,
+		`iifname "eth0" ct status dnat drop`,
+	} {
+		if !strings.Contains(rules, rule) {
+			t.Errorf("missing rule %q in:\n%s", rule, rules)
+		}
+	}
+	if strings.Contains(rules, "sctp") {
+		t.Errorf("unexpected sctp rule in:\n%s", rules)
+	}
+}
+
+func TestCatalogEntryPorts(t *testing.T) {
+	catalog := Catalog{}
+	if err := yaml.Unmarshal([]byte(`lb: {image: "manager", ports: ["80", "53/udp"]}`), &catalog); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(catalog["lb"].Ports, []nat.Port{"80/tcp", "53/udp"}) {
+		t.Errorf("unexpected ports %v", catalog["lb"].Ports)
+	}
+
+	if err := yaml.Unmarshal([]byte(`lb: {image: "manager", ports: ["http"]}`), &Catalog{}); err == nil {
+		t.Error("expected an invalid port to be refused")
+	}
+
+	if err := yaml.Unmarshal([]byte(`lb: {image: "manager", open_ports: ["443"]}`), &catalog); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(catalog["lb"].OpenPorts, []nat.Port{"443/tcp"}) {
+		t.Errorf("unexpected open ports %v", catalog["lb"].OpenPorts)
+	}
+	if err := yaml.Unmarshal([]byte(`lb: {image: "manager", open_ports: ["https"]}`), &Catalog{}); err == nil {
+		t.Error("expected an invalid open port to be refused")
+	}
+}
+
+func TestCatalogEntryPortBindings(t *testing.T) {
+	entry := &CatalogEntry{Ports: []nat.Port{"80/tcp"}}
+	exposed, bindings := entry.portBindings()
+
+	if _, found := exposed["80/tcp"]; !found {
+		t.Error("80/tcp is not exposed")
+	}
+	if !reflect.DeepEqual(bindings["80/tcp"], []nat.PortBinding{{HostPort: "80"}}) {
+		t.Errorf("unexpected bindings for 80/tcp: %v", bindings["80/tcp"])
+	}
+	// The manager's gRPC port is only reachable from the host itself
+	if !reflect.DeepEqual(bindings["50052/tcp"], []nat.PortBinding{{HostIP: "127.0.0.1"}}) {
+		t.Errorf("unexpected bindings for the gRPC port: %v", bindings["50052/tcp"])
+	}
+}
+
+func TestSyncFirewallClosesPortsOfStoppedServices(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+
+	agent.syncFirewall(Services{"lb", "dns"})
+	if !reflect.DeepEqual(agent.firewall.Open, []nat.Port{"80/tcp"}) {
+		t.Errorf("expected port 80/tcp to be open, got %v", agent.firewall.Open)
+	}
+
+	agent.syncFirewall(Services{"dns"})
+	if len(agent.firewall.Open) != 0 {
+		t.Errorf("expected no open ports, got %v", agent.firewall.Open)
+	}
+}
+
+func TestSyncFirewallOpensPortsOfManagedContainers(t *testing.T) {
+	catalog := `
+lb:
+  image: "quay.io/opencopilot/haproxy-manager"
+  ports: ["8080"]
+  open_ports: ["80", "443"]
+`
+	agent, cleanup := newTestAgent(t, catalog)
+	defer cleanup()
+
+	agent.syncFirewall(Services{"lb"})
+	if !reflect.DeepEqual(agent.firewall.Open, []nat.Port{"8080/tcp", "80/tcp", "443/tcp"}) {
+		t.Errorf("expected the published and open ports to be open, got %v", agent.firewall.Open)
+	}
+
+	// The HAProxy container the manager starts binds 80 and 443, the manager must leave them free
+	entries, _ := loadCatalog(CatalogPath)
+	_, hostConfig := managerContainer("lb", entries["lb"], "quay.io/opencopilot/haproxy-manager")
+	for _, port := range []nat.Port{"80/tcp", "443/tcp"} {
+		if _, published := hostConfig.PortBindings[port]; published {
+			t.Errorf("the manager publishes %s", port)
+		}
+	}
+	if _, published := hostConfig.PortBindings["8080/tcp"]; !published {
+		t.Error("the manager doesn't publish 8080/tcp")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	units "github.com/docker/go-units"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+// GRPCCodecConfig controls compression and message sizes of the agent's gRPC servers and clients
+type GRPCCodecConfig struct {
+	// Compress gzips the requests the agent sends to managers and peers. Importing the gzip encoding makes servers
+	// accept gzipped requests and answer them gzipped, everyone else is answered uncompressed.
+	Compress bool
+	// MaxMessageSize bounds messages in both directions, large rendered configs exceed gRPC's default of 4MB
+	MaxMessageSize int
+}
+
+// parseGRPCCodecConfig reads the GRPC_COMPRESSION and GRPC_MAX_MESSAGE_SIZE settings
+func parseGRPCCodecConfig(compression string, maxMessageSize string) (GRPCCodecConfig, error) {
+	config := GRPCCodecConfig{}
+	switch compression {
+	case "gzip":
+		config.Compress = true
+	case "", "none":
+	default:
+		return config, fmt.Errorf("invalid GRPC_COMPRESSION %q, expected gzip or none", compression)
+	}
+
+	if maxMessageSize == "" {
+		maxMessageSize = "16MiB"
+	}
+	size, err := units.RAMInBytes(maxMessageSize)
+	if err != nil {
+		return config, fmt.Errorf("invalid GRPC_MAX_MESSAGE_SIZE %q: %v", maxMessageSize, err)
+	}
+	if size <= 0 {
+		return config, fmt.Errorf("invalid GRPC_MAX_MESSAGE_SIZE %q: must be positive", maxMessageSize)
+	}
+	config.MaxMessageSize = int(size)
+	return config, nil
+}
+
+// ServerOptions applies the config to a gRPC server
+func (config GRPCCodecConfig) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(config.MaxMessageSize),
+		grpc.MaxSendMsgSize(config.MaxMessageSize),
+	}
+}
+
+// DialOptions applies the config to a gRPC client connection
+func (config GRPCCodecConfig) DialOptions() []grpc.DialOption {
+	callOpts := []grpc.CallOption{
+		grpc.MaxCallRecvMsgSize(config.MaxMessageSize),
+		grpc.MaxCallSendMsgSize(config.MaxMessageSize),
+	}
+	if config.Compress {
+		callOpts = append(callOpts, grpc.UseCompressor(gzip.Name))
+	}
+	return []grpc.DialOption{grpc.WithDefaultCallOptions(callOpts...)}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestParseGRPCCodecConfig(t *testing.T) {
+	cases := []struct {
+		compression    string
+		maxMessageSize string
+		expected       GRPCCodecConfig
+		valid          bool
+	}{
+		{"", "", GRPCCodecConfig{MaxMessageSize: 16 * 1024 * 1024}, true},
+		{"none", "", GRPCCodecConfig{MaxMessageSize: 16 * 1024 * 1024}, true},
+		{"gzip", "", GRPCCodecConfig{Compress: true, MaxMessageSize: 16 * 1024 * 1024}, true},
+		{"gzip", "64MiB", GRPCCodecConfig{Compress: true, MaxMessageSize: 64 * 1024 * 1024}, true},
+		{"", "1048576", GRPCCodecConfig{MaxMessageSize: 1024 * 1024}, true},
+		{"snappy", "", GRPCCodecConfig{}, false},
+		{"", "0", GRPCCodecConfig{}, false},
+		{"", "-1MiB", GRPCCodecConfig{}, false},
+		{"", "large", GRPCCodecConfig{}, false},
+	}
+	for _, c := range cases {
+		config, err := parseGRPCCodecConfig(c.compression, c.maxMessageSize)
+		if c.valid && (err != nil || config != c.expected) {
+			t.Errorf("expected %q and %q to give %+v, got %+v (%v)", c.compression, c.maxMessageSize, c.expected, config, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("expected %q and %q to be invalid", c.compression, c.maxMessageSize)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+// HookFailurePolicy is what happens to a service when one of its hooks fails
+type HookFailurePolicy string
+
+const (
+	// HookFailureAbort stops running the remaining hooks, and for pre-start hooks doesn't start the service
+	HookFailureAbort HookFailurePolicy = "abort"
+	// HookFailureIgnore logs the failure and carries on
+	HookFailureIgnore HookFailurePolicy = "ignore"
+)
+
+// Hook is a command run on the host, or in a throwaway container if Image is set
+type Hook struct {
+	Command   []string          `yaml:"command"`
+	Image     string            `yaml:"image"`
+	Timeout   time.Duration     `yaml:"timeout"`
+	OnFailure HookFailurePolicy `yaml:"on-failure"`
+}
+
+// Hooks are run around a service's lifecycle
+type Hooks struct {
+	PreStart []*Hook `yaml:"pre-start"`
+	PostStop []*Hook `yaml:"post-stop"`
+}
+
+func (hook *Hook) validate() error {
+	if len(hook.Command) == 0 {
+		return errors.New("hook has no command")
+	}
+	switch hook.OnFailure {
+	case "", HookFailureAbort, HookFailureIgnore:
+	default:
+		return fmt.Errorf("invalid hook on-failure %q, expected abort or ignore", hook.OnFailure)
+	}
+	return nil
+}
+
+func (hook *Hook) timeout() time.Duration {
+	if hook.Timeout == 0 {
+		return defaultHookTimeout
+	}
+	return hook.Timeout
+}
+
+// hostEnvKeys are the variables of the agent's environment that commands it runs on the host get. The rest, like
+// BOOTSTRAP_TOKEN or the DOCKER_* settings, is the agent's own.
+var hostEnvKeys = []string{"PATH", "HOME", "LANG", "TZ"}
+
+// hostEnv is the part of the agent's environment passed on to commands run on the host
+func hostEnv() []string {
+	env := []string{}
+	for _, key := range hostEnvKeys {
+		if value, found := os.LookupEnv(key); found {
+			env = append(env, key+"="+value)
+		}
+	}
+	return env
+}
+
+// hookEnv tells a hook which service it runs for
+func hookEnv(service Service) []string {
+	return []string{"CONFIG_DIR=" + ConfigDir, "INSTANCE_ID=" + InstanceID, "SERVICE=" + string(service)}
+}
+
+// runHooks runs hooks in order, returning the first failure of a hook whose policy is to abort.
+// volume is the volume backup hooks run against, nil for other hooks.
+func (agent *Agent) runHooks(service Service, stage string, hooks []*Hook, volume *dockerTypes.Volume) error {
+	for _, hook := range hooks {
+		err := agent.runHook(service, hook, volume)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("%s hook %q of %s failed: %v", stage, strings.Join(hook.Command, " "), string(service), err)
+		if hook.OnFailure == HookFailureIgnore {
+			log.Println(err)
+			continue
+		}
+		return err
+	}
+	return nil
+}
+
+func (agent *Agent) runHook(service Service, hook *Hook, volume *dockerTypes.Volume) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hook.timeout())
+	defer cancel()
+
+	if hook.Image == "" {
+		return runHostHook(ctx, service, hook, volume)
+	}
+	return agent.runContainerHook(ctx, service, hook, volume)
+}
+
+func runHostHook(ctx context.Context, service Service, hook *Hook, volume *dockerTypes.Volume) error {
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(hostEnv(), hookEnv(service)...)
+	if volume != nil {
+		cmd.Env = append(cmd.Env, volumeHookEnv(volume, volume.Mountpoint)...)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out after %s", hook.timeout())
+		}
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+func (agent *Agent) runContainerHook(ctx context.Context, service Service, hook *Hook, volume *dockerTypes.Volume) error {
+	if agent.runtime == nil {
+		return errNoRuntime
+	}
+	env := hookEnv(service)
+	binds := []string{ConfigDir + ":" + ConfigDir}
+	if volume != nil {
+		env = append(env, volumeHookEnv(volume, volumeHookPath)...)
+		binds = append(binds, volume.Name+":"+volumeHookPath)
+	}
+	reader, err := agent.runtime.ImagePull(ctx, hook.Image, dockerTypes.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		return err
+	}
+
+	res, err := agent.runtime.ContainerCreate(ctx, &container.Config{
+		Image: hook.Image,
+		Cmd:   hook.Command,
+		Env:   env,
+		Labels: map[string]string{
+			"com.opencopilot.managed":      "",
+			"com.opencopilot.service-hook": string(service),
+		},
+	}, &container.HostConfig{
+		Privileged:  true,   // Hooks are for host level setup like sysctls
+		NetworkMode: "host", // and conntrack flushes
+		Binds:       binds,
+	}, nil, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The hook context may be done already, and the container has to go either way
+		agent.runtime.ContainerRemove(context.Background(), res.ID, dockerTypes.ContainerRemoveOptions{Force: true})
+	}()
+
+	waitC, errC := agent.runtime.ContainerWait(ctx, res.ID, container.WaitConditionNextExit)
+	if err := agent.runtime.ContainerStart(ctx, res.ID, dockerTypes.ContainerStartOptions{}); err != nil {
+		return err
+	}
+
+	select {
+	case result := <-waitC:
+		if result.Error != nil {
+			return errors.New(result.Error.Message)
+		}
+		if result.StatusCode != 0 {
+			return fmt.Errorf("exited with status %d", result.StatusCode)
+		}
+		return nil
+	case err := <-errC:
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out after %s", hook.timeout())
+		}
+		return err
+	}
+}
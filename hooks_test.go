@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+)
+
+func TestHookValidate(t *testing.T) {
+	if err := (&Hook{Command: []string{"true"}, OnFailure: HookFailureIgnore}).validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (&Hook{}).validate(); err == nil {
+		t.Error("expected a hook without a command to be invalid")
+	}
+	if err := (&Hook{Command: []string{"true"}, OnFailure: "retry"}).validate(); err == nil {
+		t.Error("expected an unknown failure policy to be invalid")
+	}
+}
+
+func TestRunHostHooks(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+
+	hooks := []*Hook{
+		{Command: []string{"sh", "-c", `test "$SERVICE" = lb && test "$INSTANCE_ID" = test-instance`}},
+		{Command: []string{"false"}, OnFailure: HookFailureIgnore},
+		{Command: []string{"true"}},
+	}
+	if err := agent.runHooks("lb", "pre-start", hooks, nil); err != nil {
+		t.Error(err)
+	}
+
+	hooks = []*Hook{
+		{Command: []string{"sh", "-c", "echo no space left; exit 1"}},
+		{Command: []string{"sh", "-c", "exit 2"}},
+	}
+	err := agent.runHooks("lb", "pre-start", hooks, nil)
+	if err == nil || !strings.Contains(err.Error(), "no space left") {
+		t.Errorf("expected the first hook to fail with its output, got %v", err)
+	}
+}
+
+// withEnv sets an environment variable of the agent for a test, the returned func restores it
+func withEnv(key string, value string) func() {
+	previous, set := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if set {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestRunHostHookEnv(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	defer withEnv("BOOTSTRAP_TOKEN", "secret")()
+
+	// The hook still finds its commands, but not the agent's secrets
+	hook := &Hook{Command: []string{"sh", "-c", `test -z "$BOOTSTRAP_TOKEN" && test -n "$PATH"`}}
+	if err := agent.runHooks("lb", "pre-start", []*Hook{hook}, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunHostHookTimeout(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+
+	hook := &Hook{Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond}
+	err := agent.runHooks("lb", "post-stop", []*Hook{hook}, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected the hook to time out, got %v", err)
+	}
+}
+
+func TestRunHostHookWithVolume(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+
+	volume := &dockerTypes.Volume{Name: "opencopilot-lb-state", Mountpoint: "/var/lib/docker/volumes/opencopilot-lb-state/_data"}
+	hook := &Hook{Command: []string{"sh", "-c", `test "$VOLUME" = opencopilot-lb-state && test "$VOLUME_PATH" = /var/lib/docker/volumes/opencopilot-lb-state/_data`}}
+	if err := agent.runHooks("lb", "backup", []*Hook{hook}, volume); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunContainerHooks(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	runtime := NewFakeContainerRuntime()
+	runtime.ExitCodes = map[string]int64{"failing-hook": 3}
+	agent.runtime = runtime
+
+	if err := agent.runHooks("lb", "post-stop", []*Hook{{Image: "conntrack", Command: []string{"conntrack", "-F"}}}, nil); err != nil {
+		t.Error(err)
+	}
+	err := agent.runHooks("lb", "post-stop", []*Hook{{Image: "failing-hook", Command: []string{"conntrack", "-F"}}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "exited with status 3") {
+		t.Errorf("expected the hook to fail with its status, got %v", err)
+	}
+
+	if len(runtime.Containers) != 0 {
+		t.Errorf("hook containers were left behind: %v", runtime.Containers)
+	}
+	if len(runtime.Pulled) != 2 {
+		t.Errorf("expected the hook images to be pulled, got %v", runtime.Pulled)
+	}
+}
+
+func TestRunContainerHookWithoutRuntime(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+
+	err := agent.runHook("lb", &Hook{Image: "conntrack", Command: []string{"conntrack", "-F"}}, nil)
+	if err != errNoRuntime {
+		t.Errorf("expected errNoRuntime, got %v", err)
+	}
+}
+
+func TestFailedPreStartHookAbortsStart(t *testing.T) {
+	agent, cleanup := newTestAgent(t, `
+lb:
+  image: "quay.io/opencopilot/haproxy-manager"
+  hooks:
+    pre-start:
+      - command: ["false"]
+`)
+	defer cleanup()
+
+	if err := agent.startService("lb"); err == nil {
+		t.Error("expected the start to fail")
+	}
+	if running, _ := agent.provider.Running(context.Background()); len(running) != 0 {
+		t.Errorf("expected lb not to be started, got %v", running)
+	}
+}
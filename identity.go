@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	identityFetchTimeout = 10 * time.Second
+	// identityRetryDelay is how long the agent waits before attesting again after failing to
+	identityRetryDelay = 30 * time.Second
+)
+
+// IdentityDocument is the provider's statement of which machine the agent runs on, presented to the control plane
+// so that setting INSTANCE_ID on a stolen binary isn't enough to impersonate another instance
+type IdentityDocument struct {
+	Provider   string `json:"provider"`
+	InstanceID string `json:"instance_id"`
+	// Document is the raw document as served by the provider
+	Document string `json:"document"`
+	// Signature lets the control plane verify Document with the provider, if Document isn't signed itself
+	Signature string `json:"signature,omitempty"`
+	// Nonce is the one the control plane issued for this attestation, so an old document can't be replayed
+	Nonce string `json:"nonce"`
+}
+
+// IdentityProvider fetches the identity document of the machine the agent runs on from its metadata service.
+// Providers that can have nonce signed along with the document do so, nonce is empty when only the ID is needed.
+type IdentityProvider interface {
+	Fetch(ctx context.Context, nonce string) (*IdentityDocument, error)
+}
+
+// identityMismatchError is an identity document for another instance than InstanceID, which isn't worth retrying
+type identityMismatchError struct {
+	provider   string
+	instanceID string
+}
+
+func (e *identityMismatchError) Error() string {
+	return fmt.Sprintf("INSTANCE_ID %q doesn't match the %s instance %q", InstanceID, e.provider, e.instanceID)
+}
+
+// newIdentityProvider returns the provider named by kind, or nil if attestation is disabled
+func newIdentityProvider(kind string) (IdentityProvider, error) {
+	client := &http.Client{Timeout: identityFetchTimeout}
+	switch kind {
+	case "":
+		return nil, nil
+	case "packet":
+		return &packetIdentityProvider{client: client, baseURL: "https://metadata.platformequinix.com"}, nil
+	case "aws":
+		return &awsIdentityProvider{client: client, baseURL: "http://169.254.169.254"}, nil
+	case "gcp":
+		return &gcpIdentityProvider{client: client, baseURL: "http://metadata.google.internal"}, nil
+	default:
+		return nil, fmt.Errorf("unsupported IDENTITY_PROVIDER %q, expected packet, aws or gcp", kind)
+	}
+}
+
+// attestIdentity fetches the identity document for the nonce the control plane issued, and checks that it is for
+// the configured InstanceID
+func attestIdentity(provider IdentityProvider, store ConfigStore) (*IdentityDocument, error) {
+	nonce, err := identityNonce(store)
+	if err != nil {
+		return nil, err
+	}
+	if nonce == "" {
+		return nil, fmt.Errorf("no identity nonce at %s, the control plane has to issue one before the instance is attested", identityNonceKey())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), identityFetchTimeout)
+	defer cancel()
+
+	identity, err := provider.Fetch(ctx, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch instance identity: %v", err)
+	}
+	if identity.InstanceID != InstanceID {
+		return nil, &identityMismatchError{provider: identity.Provider, instanceID: identity.InstanceID}
+	}
+	identity.Nonce = nonce
+	return identity, nil
+}
+
+// identityKey is where the identity document of an instance is presented to the control plane
+func identityKey() string {
+	return "instances/" + InstanceID + "/identity"
+}
+
+// identityNonceKey is where the control plane issues the nonce the next identity document has to carry
+func identityNonceKey() string {
+	return "instances/" + InstanceID + "/identity-nonce"
+}
+
+// identityNonce reads the nonce issued by the control plane, empty if there is none yet
+func identityNonce(store ConfigStore) (string, error) {
+	kvs, _, err := store.List(identityNonceKey(), nil)
+	if err != nil {
+		return "", err
+	}
+	for _, kv := range kvs {
+		if kv.Key == identityNonceKey() && len(kv.Value) > 0 {
+			return string(kv.Value), nil
+		}
+	}
+	return "", nil
+}
+
+// attestNewNonce attests the instance identity and publishes it if the control plane issued a nonce other than
+// attested, returning the nonce attested last. Without a nonce there is nothing to attest yet.
+func attestNewNonce(provider IdentityProvider, store ConfigStore, attested string) (string, error) {
+	nonce, err := identityNonce(store)
+	if err != nil || nonce == "" || nonce == attested {
+		return attested, err
+	}
+	identity, err := attestIdentity(provider, store)
+	if err != nil {
+		return attested, err
+	}
+	if err := publishIdentity(store, identity); err != nil {
+		return attested, fmt.Errorf("failed to publish instance identity: %v", err)
+	}
+	log.Printf("attested instance identity with %s\n", identity.Provider)
+	return identity.Nonce, nil
+}
+
+// watchIdentityNonce attests the instance identity every time the control plane issues a new nonce. The agent runs
+// unattested until the first one, as on first boot the control plane only learns a derived instance ID from the
+// agent's registration. An identity document for another instance stops the agent.
+func watchIdentityNonce(provider IdentityProvider, store ConfigStore) {
+	var prevIndex uint64
+	attested := ""
+	for {
+		_, queryMeta, err := store.List(identityNonceKey(), &consul.QueryOptions{WaitIndex: prevIndex})
+		if err != nil {
+			log.Println(err)
+			time.Sleep(identityRetryDelay)
+			continue
+		}
+		attested, err = attestNewNonce(provider, store, attested)
+		if _, mismatch := err.(*identityMismatchError); mismatch {
+			log.Fatal(err)
+		}
+		if err != nil {
+			// prevIndex is left as is, so the nonce is attested again right after the delay
+			log.Printf("failed to attest instance identity: %v\n", err)
+			time.Sleep(identityRetryDelay)
+			continue
+		}
+		prevIndex = queryMeta.LastIndex
+	}
+}
+
+// publishIdentity presents the identity document to the control plane
+func publishIdentity(store ConfigStore, identity *IdentityDocument) error {
+	value, err := json.Marshal(identity)
+	if err != nil {
+		return err
+	}
+	_, err = store.Put(&consul.KVPair{Key: identityKey(), Value: value}, nil)
+	return err
+}
+
+func fetchMetadata(ctx context.Context, client *http.Client, method string, url string, headers map[string]string) (string, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", method, url, res.Status)
+	}
+	return string(body), nil
+}
+
+// packetIdentityProvider reads the Packet (Equinix Metal) metadata service, which is only reachable from the device
+// itself. Nothing signs the document, so the control plane has to check it against the device as the Equinix Metal
+// API knows it, and the nonce only tells it the document is fresh.
+type packetIdentityProvider struct {
+	client  *http.Client
+	baseURL string
+}
+
+func (p *packetIdentityProvider) Fetch(ctx context.Context, nonce string) (*IdentityDocument, error) {
+	document, err := fetchMetadata(ctx, p.client, "GET", p.baseURL+"/metadata", nil)
+	if err != nil {
+		return nil, err
+	}
+	var metadata struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(document), &metadata); err != nil {
+		return nil, err
+	}
+	return &IdentityDocument{Provider: "packet", InstanceID: metadata.ID, Document: document}, nil
+}
+
+// awsIdentityProvider reads the EC2 instance identity document and its PKCS7 signature through IMDSv2. Neither
+// covers the nonce, so the control plane has to refuse a document it already accepted once.
+type awsIdentityProvider struct {
+	client  *http.Client
+	baseURL string
+}
+
+func (p *awsIdentityProvider) Fetch(ctx context.Context, nonce string) (*IdentityDocument, error) {
+	token, err := fetchMetadata(ctx, p.client, "PUT", p.baseURL+"/latest/api/token", map[string]string{
+		"X-aws-ec2-metadata-token-ttl-seconds": "60",
+	})
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": token}
+
+	document, err := fetchMetadata(ctx, p.client, "GET", p.baseURL+"/latest/dynamic/instance-identity/document", headers)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := fetchMetadata(ctx, p.client, "GET", p.baseURL+"/latest/dynamic/instance-identity/pkcs7", headers)
+	if err != nil {
+		return nil, err
+	}
+	var metadata struct {
+		InstanceID string `json:"instanceId"`
+	}
+	if err := json.Unmarshal([]byte(document), &metadata); err != nil {
+		return nil, err
+	}
+	return &IdentityDocument{Provider: "aws", InstanceID: metadata.InstanceID, Document: document, Signature: signature}, nil
+}
+
+// gcpIdentityProvider reads the instance ID and a Google-signed identity token carrying the instance details,
+// with the nonce as its audience
+type gcpIdentityProvider struct {
+	client  *http.Client
+	baseURL string
+}
+
+func (p *gcpIdentityProvider) Fetch(ctx context.Context, nonce string) (*IdentityDocument, error) {
+	headers := map[string]string{"Metadata-Flavor": "Google"}
+	instanceID, err := fetchMetadata(ctx, p.client, "GET", p.baseURL+"/computeMetadata/v1/instance/id", headers)
+	if err != nil {
+		return nil, err
+	}
+	audience := "opencopilot"
+	if nonce != "" {
+		audience += ":" + nonce
+	}
+	token, err := fetchMetadata(ctx, p.client, "GET", p.baseURL+"/computeMetadata/v1/instance/service-accounts/default/identity?audience="+url.QueryEscape(audience)+"&format=full", headers)
+	if err != nil {
+		return nil, err
+	}
+	// The token is a JWT signed by Google, so it is its own signature
+	return &IdentityDocument{Provider: "gcp", InstanceID: instanceID, Document: token}, nil
+}
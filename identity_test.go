@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withInstanceID sets InstanceID for a test, the returned func restores it
+func withInstanceID(instanceID string) func() {
+	previous := InstanceID
+	InstanceID = instanceID
+	return func() { InstanceID = previous }
+}
+
+func TestNewIdentityProvider(t *testing.T) {
+	if provider, err := newIdentityProvider(""); provider != nil || err != nil {
+		t.Errorf("expected no provider, got %v (%v)", provider, err)
+	}
+	if _, err := newIdentityProvider("azure"); err == nil {
+		t.Error("expected azure to be unsupported")
+	}
+	for _, kind := range []string{"packet", "aws", "gcp"} {
+		if provider, err := newIdentityProvider(kind); provider == nil || err != nil {
+			t.Errorf("expected a %s provider, got %v (%v)", kind, provider, err)
+		}
+	}
+}
+
+func TestPacketIdentityProvider(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metadata" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"id": "6f3a1c2e-device", "hostname": "edge-1"}`))
+	}))
+	defer metadata.Close()
+
+	provider := &packetIdentityProvider{client: metadata.Client(), baseURL: metadata.URL}
+	identity, err := provider.Fetch(context.Background(), "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The whole document is presented, so the control plane can check it against the Equinix Metal API
+	if identity.Provider != "packet" || identity.InstanceID != "6f3a1c2e-device" || !strings.Contains(identity.Document, "edge-1") || identity.Signature != "" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+}
+
+func TestAWSIdentityProvider(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != "PUT" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Write([]byte("session-token"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "session-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/dynamic/instance-identity/document":
+			w.Write([]byte(`{"instanceId": "i-0123456789", "region": "eu-west-1"}`))
+		case "/latest/dynamic/instance-identity/pkcs7":
+			w.Write([]byte("signature"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer metadata.Close()
+
+	provider := &awsIdentityProvider{client: metadata.Client(), baseURL: metadata.URL}
+	identity, err := provider.Fetch(context.Background(), "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Provider != "aws" || identity.InstanceID != "i-0123456789" || identity.Signature != "signature" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+}
+
+func TestGCPIdentityProvider(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/id":
+			w.Write([]byte("4567"))
+		case "/computeMetadata/v1/instance/service-accounts/default/identity":
+			// The token stands in for a JWT with the requested audience
+			w.Write([]byte("jwt-for-" + r.URL.Query().Get("audience")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer metadata.Close()
+
+	provider := &gcpIdentityProvider{client: metadata.Client(), baseURL: metadata.URL}
+	identity, err := provider.Fetch(context.Background(), "n0nce&more")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.InstanceID != "4567" || identity.Document != "jwt-for-opencopilot:n0nce&more" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	identity, err = provider.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Document != "jwt-for-opencopilot" {
+		t.Errorf("unexpected document without a nonce %q", identity.Document)
+	}
+}
+
+func TestFetchMetadataFailure(t *testing.T) {
+	metadata := httptest.NewServer(http.NotFoundHandler())
+	defer metadata.Close()
+
+	provider := &gcpIdentityProvider{client: metadata.Client(), baseURL: metadata.URL}
+	if _, err := provider.Fetch(context.Background(), ""); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected the status to be reported, got %v", err)
+	}
+}
+
+func TestAttestIdentity(t *testing.T) {
+	defer withInstanceID("i-0123456789")()
+	store := &FakeConfigStore{}
+	provider := &FakeIdentityProvider{Identity: &IdentityDocument{Provider: "aws", InstanceID: "i-0123456789", Document: "{}"}}
+
+	if _, err := attestIdentity(provider, store); err == nil {
+		t.Error("expected attestation without a nonce to fail")
+	}
+
+	store.Set(identityNonceKey(), []byte("issued-nonce"))
+	identity, err := attestIdentity(provider, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Nonce != "issued-nonce" {
+		t.Errorf("expected the issued nonce, got %q", identity.Nonce)
+	}
+
+	if err := publishIdentity(store, identity); err != nil {
+		t.Fatal(err)
+	}
+	kvs, _, _ := store.List(identityKey(), nil)
+	var published IdentityDocument
+	for _, kv := range kvs {
+		if kv.Key == identityKey() {
+			if err := json.Unmarshal(kv.Value, &published); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if published != *identity {
+		t.Errorf("unexpected published identity %+v", published)
+	}
+}
+
+func TestAttestIdentityMismatch(t *testing.T) {
+	defer withInstanceID("i-0123456789")()
+	store := &FakeConfigStore{}
+	store.Set(identityNonceKey(), []byte("issued-nonce"))
+
+	provider := &FakeIdentityProvider{Identity: &IdentityDocument{Provider: "aws", InstanceID: "i-9876543210"}}
+	if _, err := attestIdentity(provider, store); err == nil {
+		t.Error("expected another instance's identity to be refused")
+	} else if _, mismatch := err.(*identityMismatchError); !mismatch {
+		t.Errorf("expected a mismatch error, got %v", err)
+	}
+
+	provider = &FakeIdentityProvider{Err: errors.New("metadata service unreachable")}
+	if _, err := attestIdentity(provider, store); err == nil {
+		t.Error("expected a failed fetch to fail the attestation")
+	}
+}
+
+// publishedIdentity returns the identity document published in store, nil if there is none
+func publishedIdentity(t *testing.T, store *FakeConfigStore) *IdentityDocument {
+	kvs, _, _ := store.List(identityKey(), nil)
+	for _, kv := range kvs {
+		if kv.Key == identityKey() {
+			identity := &IdentityDocument{}
+			if err := json.Unmarshal(kv.Value, identity); err != nil {
+				t.Fatal(err)
+			}
+			return identity
+		}
+	}
+	return nil
+}
+
+func TestAttestNewNonce(t *testing.T) {
+	defer withInstanceID("i-0123456789")()
+	store := &FakeConfigStore{}
+	provider := &FakeIdentityProvider{Identity: &IdentityDocument{Provider: "aws", InstanceID: "i-0123456789", Document: "{}"}}
+
+	// Before the control plane issues a nonce, the agent runs unattested
+	attested, err := attestNewNonce(provider, store, "")
+	if err != nil || attested != "" {
+		t.Fatalf("expected nothing to attest, got %q (%v)", attested, err)
+	}
+	if provider.Fetches != 0 || publishedIdentity(t, store) != nil {
+		t.Error("an identity was attested without a nonce")
+	}
+
+	store.Set(identityNonceKey(), []byte("first-nonce"))
+	if attested, err = attestNewNonce(provider, store, attested); err != nil || attested != "first-nonce" {
+		t.Fatalf("expected the first nonce to be attested, got %q (%v)", attested, err)
+	}
+	if identity := publishedIdentity(t, store); identity == nil || identity.Nonce != "first-nonce" {
+		t.Errorf("unexpected published identity %+v", identity)
+	}
+
+	// The same nonce isn't attested twice, a new one is
+	attestNewNonce(provider, store, attested)
+	if provider.Fetches != 1 {
+		t.Errorf("expected a single fetch for the same nonce, got %d", provider.Fetches)
+	}
+	store.Set(identityNonceKey(), []byte("second-nonce"))
+	if attested, err = attestNewNonce(provider, store, attested); err != nil || attested != "second-nonce" {
+		t.Fatalf("expected the second nonce to be attested, got %q (%v)", attested, err)
+	}
+
+	// A failed attestation leaves the last attested nonce, so it is tried again
+	provider.Err = errors.New("metadata service unreachable")
+	store.Set(identityNonceKey(), []byte("third-nonce"))
+	if attested, err = attestNewNonce(provider, store, attested); err == nil || attested != "second-nonce" {
+		t.Errorf("expected the attestation to fail and keep the second nonce, got %q (%v)", attested, err)
+	}
+}
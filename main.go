@@ -1,20 +1,22 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"log"
 	"net"
 	"os"
 	"strconv"
 	"time"
 
-	dockerClient "github.com/docker/docker/client"
 	consul "github.com/hashicorp/consul/api"
 	pb "github.com/opencopilot/agent/agent"
 	pbHealth "github.com/opencopilot/agent/health"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
@@ -25,77 +27,155 @@ import (
 var (
 	// InstanceID is the identifier of this agent/device
 	InstanceID = os.Getenv("INSTANCE_ID")
+	// InstanceIDSource is where to derive InstanceID from when INSTANCE_ID is unset, metadata, machine-id or bootstrap
+	InstanceIDSource = os.Getenv("INSTANCE_ID_SOURCE")
+	// BootstrapURL is the control plane endpoint exchanging BootstrapToken for an instance ID
+	BootstrapURL = os.Getenv("BOOTSTRAP_URL")
+	// BootstrapToken is the one-time token exchanged for an instance ID
+	BootstrapToken = os.Getenv("BOOTSTRAP_TOKEN")
 	// ConfigDir is the config directory of opencopilot on the host
 	ConfigDir = os.Getenv("CONFIG_DIR")
+	// DockerHost is the docker daemon to manage services on, e.g. unix:///var/run/docker.sock or tcp://10.0.0.2:2376
+	DockerHost = os.Getenv("DOCKER_HOST")
+	// DockerCertPath is the directory holding ca.pem, cert.pem and key.pem for a TLS DockerHost
+	DockerCertPath = os.Getenv("DOCKER_CERT_PATH")
+	// DockerTLSVerify requires the docker daemon's certificate to be verified against DockerCertPath/ca.pem
+	DockerTLSVerify = os.Getenv("DOCKER_TLS_VERIFY") != ""
+	// SiteID is the site this device is at, agents at the same site federate to answer for each other
+	SiteID = os.Getenv("SITE_ID")
+	// IdentityProviderKind is the metadata service attesting which instance this is, packet, aws or gcp, empty to disable
+	IdentityProviderKind = os.Getenv("IDENTITY_PROVIDER")
+	// GRPCCompression is gzip to compress the requests the agent sends to managers and peers, or none (the default)
+	GRPCCompression = os.Getenv("GRPC_COMPRESSION")
+	// GRPCMaxMessageSize bounds gRPC messages, e.g. 32MiB, defaulting to 16MiB
+	GRPCMaxMessageSize = os.Getenv("GRPC_MAX_MESSAGE_SIZE")
+	// ServiceProviderKind is how managers are run, docker (the default) or process to run them as host processes
+	ServiceProviderKind = os.Getenv("SERVICE_PROVIDER")
+	// FirewallKind is the firewall backend guarding published service ports, iptables or nftables, empty to disable
+	FirewallKind = os.Getenv("FIREWALL")
+	// FirewallInterface is the public interface the firewall filters traffic from
+	FirewallInterface = os.Getenv("FIREWALL_INTERFACE")
 )
 
 const (
-	port = 50051
+	port           = 50051
+	privateAddress = "127.0.0.1:50050"
 )
 
-func servePublicGRPC(server *server) {
-	lis, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+func serveGRPC(server *server, address string, opts ...grpc.ServerOption) {
+	lis, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	logger, err := zap.NewProduction()
-	defer logger.Sync()
-	if err != nil {
-		log.Fatalf("failed to setup logger: %v", err)
+	s := grpc.NewServer(opts...)
+	pb.RegisterAgentServer(s, server)
+	pbHealth.RegisterHealthServer(s, server)
+	// Register reflection service on gRPC server.
+	reflection.Register(s)
+	if err := s.Serve(lis); err != nil {
+		log.Fatalf("failed to serve: %v", err)
 	}
+}
 
+func servePublicGRPC(server *server, logger *zap.Logger, codec GRPCCodecConfig) {
 	// TODO: TLS for gRPC connection to outside world
 	// creds, err := credentials.NewServerTLSFromFile("server.crt", "server.key")
 	// if err != nil {
 	// 	log.Fatalf("failed to load credentials: %v", err)
 	// }
 
-	s := grpc.NewServer(
+	serveGRPC(server, ":"+strconv.Itoa(port), append(codec.ServerOptions(),
 		// grpc.Creds(creds),
 		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
 			grpc_ctxtags.StreamServerInterceptor(grpc_ctxtags.WithFieldExtractor(grpc_ctxtags.CodeGenRequestFieldExtractor)),
 			grpc_zap.StreamServerInterceptor(logger),
+			publicOnlyStreamInterceptor,
 			grpc_recovery.StreamServerInterceptor(),
 		)),
 		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
 			grpc_ctxtags.UnaryServerInterceptor(grpc_ctxtags.WithFieldExtractor(grpc_ctxtags.CodeGenRequestFieldExtractor)),
 			grpc_zap.UnaryServerInterceptor(logger),
+			publicOnlyUnaryInterceptor,
 			grpc_recovery.UnaryServerInterceptor(),
 		)),
-	)
+	)...)
+}
 
-	pb.RegisterAgentServer(s, server)
-	pbHealth.RegisterHealthServer(s, server)
-	// Register reflection service on gRPC server.
-	reflection.Register(s)
-	s.Serve(lis)
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+func servePrivateGRPC(server *server, codec GRPCCodecConfig) {
+	// The private endpoint is only for processes on this device, so it skips request logging
+	// but refuses anything that doesn't come from the loopback interface
+	serveGRPC(server, privateAddress, append(codec.ServerOptions(),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
+			loopbackOnlyStreamInterceptor,
+			grpc_recovery.StreamServerInterceptor(),
+		)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
+			loopbackOnlyUnaryInterceptor,
+			grpc_recovery.UnaryServerInterceptor(),
+		)),
+	)...)
+}
+
+// privateMethods take services down, so they are only served on the private endpoint
+var privateMethods = map[string]bool{
+	"/opencopilot.Agent/PauseReconciliation":  true,
+	"/opencopilot.Agent/ResumeReconciliation": true,
+	"/opencopilot.Agent/Drain":                true,
+}
+
+func checkPublicMethod(method string) error {
+	if privateMethods[method] {
+		return status.Errorf(codes.PermissionDenied, "%s is only served on the private endpoint", method)
 	}
+	return nil
 }
 
-func servePrivateGRPC(server *server) {
-	lis, err := net.Listen("tcp", "127.0.0.1:50050")
-	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+func publicOnlyUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := checkPublicMethod(info.FullMethod); err != nil {
+		return nil, err
 	}
-	s := grpc.NewServer()
-	pb.RegisterAgentServer(s, server)
+	return handler(ctx, req)
+}
 
-	// Register reflection service on gRPC server.
-	reflection.Register(s)
-	s.Serve(lis)
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+func publicOnlyStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := checkPublicMethod(info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+func checkLoopbackPeer(ctx context.Context) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.PermissionDenied, "unknown peer")
+	}
+	addr, ok := p.Addr.(*net.TCPAddr)
+	if !ok || !addr.IP.IsLoopback() {
+		return status.Errorf(codes.PermissionDenied, "peer %s is not local", p.Addr)
+	}
+	return nil
+}
+
+func loopbackOnlyUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := checkLoopbackPeer(ctx); err != nil {
+		return nil, err
 	}
+	return handler(ctx, req)
+}
+
+func loopbackOnlyStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := checkLoopbackPeer(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
 }
 
 func watchConfigTree(agent *Agent, queue chan consul.KVPairs) {
-	kv := agent.consulCli.KV()
 	var prevIndex uint64
+	var prevHash string
 	for {
-		kvs, queryMeta, err := kv.List("instances/"+InstanceID+"/services/", &consul.QueryOptions{
+		kvs, queryMeta, err := agent.configStore.List("instances/"+InstanceID+"/services/", &consul.QueryOptions{
 			WaitIndex: prevIndex,
 		})
 		if err != nil {
@@ -103,21 +183,25 @@ func watchConfigTree(agent *Agent, queue chan consul.KVPairs) {
 		}
 		lastIndex := queryMeta.LastIndex
 		if prevIndex != lastIndex {
-			queue <- kvs
 			prevIndex = lastIndex
+			kvs = withoutStatusKeys(kvs)
+			// The agent's own status writes bump the index too, they are no reason to sync
+			if hash := kvsHash(kvs); hash != prevHash {
+				queue <- kvs
+				prevHash = hash
+			}
 		}
 	}
 }
 
 func pollConfigTree(agent *Agent, queue chan consul.KVPairs, interval time.Duration) {
-	kv := agent.consulCli.KV()
 	for {
-		kvs, _, err := kv.List("instances/"+InstanceID+"/services", nil)
+		kvs, _, err := agent.configStore.List("instances/"+InstanceID+"/services", nil)
 		if err != nil {
 			log.Fatal(err)
 		}
 		select {
-		case queue <- kvs:
+		case queue <- withoutStatusKeys(kvs):
 		default:
 			// something is already in the queue, lets not add to
 		}
@@ -125,11 +209,23 @@ func pollConfigTree(agent *Agent, queue chan consul.KVPairs, interval time.Durat
 	}
 }
 
-func registerService(consulCli *consul.Client) {
-	agent := consulCli.Agent()
-	err := agent.ServiceRegister(&consul.AgentServiceRegistration{
+func registerService(registry ServiceRegistry, identityProvider string) {
+	tags := []string{}
+	meta := map[string]string{}
+	if SiteID != "" {
+		// Peers at the same site find each other by this tag
+		tags = append(tags, SiteID)
+		meta["site"] = SiteID
+	}
+	if identityProvider != "" {
+		// The document itself is too large for service metadata, it lives under identityKey()
+		meta["identity-provider"] = identityProvider
+	}
+	err := registry.ServiceRegister(&consul.AgentServiceRegistration{
 		ID:   InstanceID,
-		Name: "opencopilot-agent",
+		Name: agentServiceName,
+		Tags: tags,
+		Meta: meta,
 		Port: port,
 		Check: &consul.AgentServiceCheck{
 			CheckID:  "agent-grpc",
@@ -144,8 +240,16 @@ func registerService(consulCli *consul.Client) {
 }
 
 func main() {
+	identityProvider, err := newIdentityProvider(IdentityProviderKind)
+	if err != nil {
+		log.Fatalf("invalid identity configuration: %v", err)
+	}
+
 	if InstanceID == "" {
-		panic(errors.New("No instance ID specified"))
+		if InstanceID, err = bootstrapInstanceID(InstanceIDSource, identityProvider); err != nil {
+			log.Fatalf("failed to bootstrap instance ID (INSTANCE_ID_SOURCE=%q): %v", InstanceIDSource, err)
+		}
+		log.Printf("using instance ID %s\n", InstanceID)
 	}
 
 	consulClientConfig := consul.DefaultConfig()
@@ -158,16 +262,51 @@ func main() {
 		log.Fatalf("failed to initialize consul client")
 	}
 
-	dockerCli, err := dockerClient.NewClientWithOpts(dockerClient.WithVersion("1.37"))
+	// Devices running managers as host processes may not have docker at all
+	var runtime ContainerRuntime
+	if ServiceProviderKind != "process" {
+		if err := validateDockerConfig(); err != nil {
+			log.Fatalf("invalid docker configuration: %v", err)
+		}
+
+		dockerCli, err := newDockerClient()
+		if err != nil {
+			log.Fatalf("failed to initialize docker client: %v", err)
+		}
+
+		if err := checkDockerConnectivity(dockerCli); err != nil {
+			log.Fatal(err)
+		}
+		runtime = dockerCli
+	}
+
+	provider, err := newServiceProvider(ServiceProviderKind, runtime)
+	if err != nil {
+		log.Fatalf("invalid service provider configuration: %v", err)
+	}
+
+	firewall, err := newFirewall(FirewallKind, FirewallInterface)
 	if err != nil {
-		log.Fatalf("failed to initialize docker client")
+		log.Fatalf("invalid firewall configuration: %v", err)
 	}
 
-	server := &server{
-		dockerCli: dockerCli,
-		consulCli: consulCli,
+	codec, err := parseGRPCCodecConfig(GRPCCompression, GRPCMaxMessageSize)
+	if err != nil {
+		log.Fatalf("invalid gRPC configuration: %v", err)
 	}
 
+	federation := newFederation(SiteID, consulCli.Health(), newPeerDialer(codec.DialOptions()...))
+	server, err := newServer(runtime, provider, consulCli.KV(), consulCli.Agent(), newManagerDialer(codec.DialOptions()...), firewall, federation)
+	if err != nil {
+		log.Fatalf("failed to initialize server: %v", err)
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		log.Fatalf("failed to setup logger: %v", err)
+	}
+	defer logger.Sync()
+
 	agent := server.ToAgent()
 	queue := make(chan consul.KVPairs, 1)
 
@@ -175,13 +314,18 @@ func main() {
 	go watchConfigTree(agent, queue)
 
 	log.Println("starting public gRPC...")
-	go servePublicGRPC(server)
+	go servePublicGRPC(server, logger, codec)
 
 	log.Println("starting private gRPC...")
-	go servePrivateGRPC(server)
+	go servePrivateGRPC(server, codec)
 
 	log.Println("registering service...")
-	registerService(consulCli)
+	registerService(consulCli.Agent(), IdentityProviderKind)
+
+	if identityProvider != nil {
+		log.Println("starting to watch for identity nonces...")
+		go watchIdentityNonce(identityProvider, consulCli.KV())
+	}
 
 	log.Println("starting to poll Consul KV...")
 	interval, _ := time.ParseDuration("15s") // Move this to an ENV var?
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestPublicEndpointRefusesPrivateMethods(t *testing.T) {
+	handled := false
+	unaryHandler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		handled = true
+		return nil, nil
+	}
+	streamHandler := func(srv interface{}, stream grpc.ServerStream) error {
+		handled = true
+		return nil
+	}
+
+	for _, method := range []string{"/opencopilot.Agent/PauseReconciliation", "/opencopilot.Agent/ResumeReconciliation"} {
+		handled = false
+		_, err := publicOnlyUnaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, unaryHandler)
+		if status.Code(err) != codes.PermissionDenied || handled {
+			t.Errorf("expected %s to be refused on the public endpoint, got %v", method, err)
+		}
+	}
+	handled = false
+	err := publicOnlyStreamInterceptor(nil, nil, &grpc.StreamServerInfo{FullMethod: "/opencopilot.Agent/Drain"}, streamHandler)
+	if status.Code(err) != codes.PermissionDenied || handled {
+		t.Errorf("expected Drain to be refused on the public endpoint, got %v", err)
+	}
+
+	handled = false
+	if _, err := publicOnlyUnaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/opencopilot.Agent/GetStatus"}, unaryHandler); err != nil || !handled {
+		t.Errorf("expected GetStatus to be served on the public endpoint, got %v", err)
+	}
+	handled = false
+	if err := publicOnlyStreamInterceptor(nil, nil, &grpc.StreamServerInfo{FullMethod: "/opencopilot.Agent/GetServiceLogs"}, streamHandler); err != nil || !handled {
+		t.Errorf("expected GetServiceLogs to be served on the public endpoint, got %v", err)
+	}
+}
+
+func TestPrivateEndpointOnlyServesLoopback(t *testing.T) {
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "served", nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/opencopilot.Agent/PauseReconciliation"}
+
+	cases := []struct {
+		addr    net.Addr
+		allowed bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 40000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}, false},
+		{&net.UnixAddr{Name: "/run/agent.sock", Net: "unix"}, false},
+	}
+	for _, c := range cases {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: c.addr})
+		res, err := loopbackOnlyUnaryInterceptor(ctx, nil, info, handler)
+		if c.allowed && (err != nil || res != "served") {
+			t.Errorf("expected a call from %s to be served, got %v", c.addr, err)
+		}
+		if !c.allowed && status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected a call from %s to be refused, got %v", c.addr, err)
+		}
+	}
+
+	if _, err := loopbackOnlyUnaryInterceptor(context.Background(), nil, info, handler); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected a call without a peer to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Maintenance pauses reconciliation while operators work on the device, so the agent doesn't restart containers
+// they stopped on purpose. The flag is persisted under ConfigDir so it survives agent restarts.
+type Maintenance struct {
+	mu      sync.Mutex
+	path    string
+	state   maintenanceState
+	resumed chan struct{}
+	// reconcile is held while reconciling, so that once Pause returns nothing touches the services anymore
+	reconcile sync.Mutex
+}
+
+type maintenanceState struct {
+	Paused bool      `json:"paused"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// maintenanceFile is where the maintenance flag is persisted, or empty if there is no ConfigDir
+func maintenanceFile() string {
+	if ConfigDir == "" {
+		return ""
+	}
+	return filepath.Join(ConfigDir, "maintenance")
+}
+
+// loadMaintenance restores the maintenance flag persisted at path, if any
+func loadMaintenance(path string) (*Maintenance, error) {
+	maintenance := &Maintenance{path: path, resumed: make(chan struct{}, 1)}
+	if path == "" {
+		log.Println("warning: CONFIG_DIR is not set, maintenance mode won't survive restarts")
+		return maintenance, nil
+	}
+
+	persisted, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return maintenance, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(persisted, &maintenance.state); err != nil {
+		return nil, err
+	}
+	if maintenance.state.Paused {
+		log.Printf("reconciliation is paused since %s: %s\n", maintenance.state.Since, maintenance.state.Reason)
+	}
+	return maintenance, nil
+}
+
+// Paused reports whether reconciliation is paused
+func (maintenance *Maintenance) Paused() bool {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+
+	return maintenance.state.Paused
+}
+
+// Pause stops reconciliation until Resume is called, keeping the reason and time of an earlier pause. It waits for
+// a reconcile in progress to finish.
+func (maintenance *Maintenance) Pause(reason string) (maintenanceState, error) {
+	maintenance.reconcile.Lock()
+	defer maintenance.reconcile.Unlock()
+
+	return maintenance.pause(reason)
+}
+
+// PauseFor pauses reconciliation and runs run with no reconcile in progress. Reconciliation can't run again until
+// run returns, and stays paused after that until Resume is called.
+func (maintenance *Maintenance) PauseFor(reason string, run func() error) error {
+	maintenance.reconcile.Lock()
+	defer maintenance.reconcile.Unlock()
+
+	if _, err := maintenance.pause(reason); err != nil {
+		return err
+	}
+	return run()
+}
+
+// Reconcile runs reconcile unless reconciliation is paused, reporting whether it ran
+func (maintenance *Maintenance) Reconcile(reconcile func()) bool {
+	maintenance.reconcile.Lock()
+	defer maintenance.reconcile.Unlock()
+
+	if maintenance.Paused() {
+		return false
+	}
+	reconcile()
+	return true
+}
+
+func (maintenance *Maintenance) pause(reason string) (maintenanceState, error) {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+
+	if maintenance.state.Paused {
+		return maintenance.state, nil
+	}
+	state := maintenanceState{Paused: true, Reason: reason, Since: time.Now().UTC()}
+	if err := maintenance.persist(state); err != nil {
+		return maintenance.state, err
+	}
+	maintenance.state = state
+	log.Printf("pausing reconciliation: %s\n", reason)
+	return maintenance.state, nil
+}
+
+// Resume restarts reconciliation, waking up the config handler to catch up on what changed meanwhile
+func (maintenance *Maintenance) Resume() (maintenanceState, error) {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+
+	if !maintenance.state.Paused {
+		return maintenance.state, nil
+	}
+	if err := maintenance.persist(maintenanceState{}); err != nil {
+		return maintenance.state, err
+	}
+	maintenance.state = maintenanceState{}
+	log.Println("resuming reconciliation")
+	select {
+	case maintenance.resumed <- struct{}{}:
+	default:
+	}
+	return maintenance.state, nil
+}
+
+// State returns the current maintenance state
+func (maintenance *Maintenance) State() maintenanceState {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+
+	return maintenance.state
+}
+
+// Resumed is signalled every time reconciliation resumes
+func (maintenance *Maintenance) Resumed() <-chan struct{} {
+	return maintenance.resumed
+}
+
+func (maintenance *Maintenance) persist(state maintenanceState) error {
+	if maintenance.path == "" {
+		return nil
+	}
+	if !state.Paused {
+		if err := os.Remove(maintenance.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(maintenance.path, value, 0600)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestMaintenanceSurvivesRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maintenance-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "maintenance")
+
+	maintenance, err := loadMaintenance(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maintenance.Paused() {
+		t.Fatal("expected a fresh agent not to be paused")
+	}
+	paused, err := maintenance.Pause("swapping the LB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pausing again keeps the reason and time of the first pause
+	if again, _ := maintenance.Pause("another reason"); again != paused {
+		t.Errorf("expected the first pause to be kept, got %+v", again)
+	}
+
+	restarted, err := loadMaintenance(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := restarted.State(); !state.Paused || state.Reason != "swapping the LB" || !state.Since.Equal(paused.Since) {
+		t.Errorf("the pause didn't survive a restart, got %+v", state)
+	}
+
+	if _, err := restarted.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("the maintenance file was left behind")
+	}
+	if restarted, _ := loadMaintenance(path); restarted.Paused() {
+		t.Error("the resume didn't survive a restart")
+	}
+}
+
+func TestPauseWaitsForReconcile(t *testing.T) {
+	maintenance, _ := loadMaintenance("")
+	reconciling := make(chan struct{})
+	release := make(chan struct{})
+	go maintenance.Reconcile(func() {
+		close(reconciling)
+		<-release
+	})
+	<-reconciling
+
+	paused := make(chan struct{})
+	go func() {
+		maintenance.Pause("maintenance")
+		close(paused)
+	}()
+	select {
+	case <-paused:
+		t.Fatal("Pause returned while a reconcile was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-paused:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pause didn't return once the reconcile finished")
+	}
+	if maintenance.Reconcile(func() { t.Error("reconciled while paused") }) {
+		t.Error("expected Reconcile to report it didn't run")
+	}
+}
+
+func TestResumeWakesConfigHandler(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.maintenance, _ = loadMaintenance(filepath.Join(ConfigDir, "maintenance"))
+	queue := make(chan consul.KVPairs, 1)
+	go agent.startConfigHandler(queue)
+	list := func() consul.KVPairs {
+		kvs, _, _ := agent.store.List("instances/"+InstanceID, &consul.QueryOptions{})
+		return kvs
+	}
+
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	queue <- list()
+	eventually(t, "lb to be configured", func() bool { return len(agent.configs("lb")) == 1 })
+
+	agent.maintenance.Pause("swapping the LB")
+	// The operator stops lb by hand, and the config changes meanwhile
+	agent.provider.Stop(context.Background(), "lb")
+	agent.setConfig("dns", "zone", "example.com")
+	queue <- list()
+	time.Sleep(50 * time.Millisecond)
+	if agent.running(t, "lb") || agent.running(t, "dns") {
+		t.Fatal("services were touched while paused")
+	}
+
+	agent.maintenance.Resume()
+	eventually(t, "the latest config to be applied", func() bool {
+		return len(agent.configs("lb")) == 2 && len(agent.configs("dns")) == 1
+	})
+}
+
+func TestResumeReconfiguresUnchangedServices(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.maintenance, _ = loadMaintenance(filepath.Join(ConfigDir, "maintenance"))
+	queue := make(chan consul.KVPairs, 1)
+	go agent.startConfigHandler(queue)
+
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	kvs, _, _ := agent.store.List("instances/"+InstanceID, &consul.QueryOptions{})
+	queue <- kvs
+	eventually(t, "lb to be configured", func() bool { return len(agent.configs("lb")) == 1 })
+
+	// lb keeps running, but may have been reconfigured by hand while paused, so it's sent its config again
+	agent.maintenance.Pause("debugging")
+	agent.maintenance.Resume()
+	eventually(t, "lb to be configured again", func() bool { return len(agent.configs("lb")) == 2 })
+}
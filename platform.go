@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Platform is the OS and CPU a docker daemon runs images for
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// String formats the platform the way docker does, e.g. linux/arm/v7
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// Key is how the platform is referred to in the catalog, e.g. amd64, arm64 or armv7
+func (p Platform) Key() string {
+	return p.Architecture + p.Variant
+}
+
+// matches reports whether an entry of a manifest list can run on p
+func (p Platform) matches(candidate specs.Platform) bool {
+	if candidate.OS != p.OS || candidate.Architecture != p.Architecture {
+		return false
+	}
+	// arm64 images are published both with and without a v8 variant
+	return p.Variant == "" || candidate.Variant == "" || candidate.Variant == p.Variant
+}
+
+// unameArchitectures maps the architecture reported by the docker daemon (uname -m) to its OCI name and variant
+var unameArchitectures = map[string]Platform{
+	"x86_64":  {Architecture: "amd64"},
+	"amd64":   {Architecture: "amd64"},
+	"i386":    {Architecture: "386"},
+	"i686":    {Architecture: "386"},
+	"aarch64": {Architecture: "arm64"},
+	"arm64":   {Architecture: "arm64"},
+	"armv7l":  {Architecture: "arm", Variant: "v7"},
+	"armv6l":  {Architecture: "arm", Variant: "v6"},
+}
+
+// daemonPlatform asks the docker daemon which platform it runs, which may differ from the agent's with a remote DOCKER_HOST
+func daemonPlatform(ctx context.Context, runtime ContainerRuntime) (Platform, error) {
+	info, err := runtime.Info(ctx)
+	if err != nil {
+		return Platform{}, err
+	}
+	platform, found := unameArchitectures[info.Architecture]
+	if !found {
+		return Platform{}, fmt.Errorf("unsupported docker architecture %q", info.Architecture)
+	}
+	platform.OS = strings.ToLower(info.OSType)
+	return platform, nil
+}
+
+// resolveImage picks the image to run for a service on platform, and checks with the registry that it has a variant for it
+func resolveImage(ctx context.Context, runtime ContainerRuntime, entry *CatalogEntry, platform Platform) (string, error) {
+	image := entry.ImageFor(platform)
+	if image == "" {
+		return "", fmt.Errorf("no image for platform %s", platform)
+	}
+
+	distribution, err := runtime.DistributionInspect(ctx, image, "")
+	if err != nil {
+		// Not every registry or daemon supports this, let the pull decide
+		log.Printf("could not inspect platforms of %s: %v\n", image, err)
+		return image, nil
+	}
+	if len(distribution.Platforms) == 0 {
+		return image, nil
+	}
+
+	available := []string{}
+	for _, candidate := range distribution.Platforms {
+		if platform.matches(candidate) {
+			return image, nil
+		}
+		available = append(available, Platform{OS: candidate.OS, Architecture: candidate.Architecture, Variant: candidate.Variant}.String())
+	}
+	return "", fmt.Errorf("image %s has no %s variant (available: %s), add a %q override to the catalog", image, platform, strings.Join(available, ", "), platform.Key())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDaemonPlatform(t *testing.T) {
+	cases := map[string]Platform{
+		"x86_64":  {OS: "linux", Architecture: "amd64"},
+		"aarch64": {OS: "linux", Architecture: "arm64"},
+		"armv7l":  {OS: "linux", Architecture: "arm", Variant: "v7"},
+	}
+	for architecture, expected := range cases {
+		runtime := NewFakeContainerRuntime()
+		runtime.Architecture = architecture
+		platform, err := daemonPlatform(context.Background(), runtime)
+		if err != nil {
+			t.Errorf("%s: %v", architecture, err)
+			continue
+		}
+		if platform != expected {
+			t.Errorf("expected %s to be %s, got %s", architecture, expected, platform)
+		}
+	}
+
+	runtime := NewFakeContainerRuntime()
+	runtime.Architecture = "mips"
+	if _, err := daemonPlatform(context.Background(), runtime); err == nil {
+		t.Error("expected mips to be unsupported")
+	}
+}
+
+func TestPlatformKey(t *testing.T) {
+	platform := Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	if platform.Key() != "armv7" {
+		t.Errorf("unexpected key %s", platform.Key())
+	}
+	if platform.String() != "linux/arm/v7" {
+		t.Errorf("unexpected string %s", platform.String())
+	}
+}
+
+func TestPlatformMatches(t *testing.T) {
+	arm64 := Platform{OS: "linux", Architecture: "arm64"}
+	armv7 := Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+
+	if !arm64.matches(specs.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}) {
+		t.Error("expected arm64 to match arm64/v8")
+	}
+	if !armv7.matches(specs.Platform{OS: "linux", Architecture: "arm"}) {
+		t.Error("expected arm/v7 to match arm without a variant")
+	}
+	if armv7.matches(specs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}) {
+		t.Error("expected arm/v7 not to match arm/v6")
+	}
+	if arm64.matches(specs.Platform{OS: "windows", Architecture: "arm64"}) {
+		t.Error("expected linux not to match windows")
+	}
+}
+
+func TestResolveImage(t *testing.T) {
+	runtime := NewFakeContainerRuntime()
+	runtime.Platforms = map[string][]specs.Platform{
+		"manager": {{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+	}
+	entry := &CatalogEntry{Image: "manager", Platforms: map[string]string{"armv7": "manager:armv7"}}
+
+	image, err := resolveImage(context.Background(), runtime, entry, Platform{OS: "linux", Architecture: "arm64"})
+	if err != nil || image != "manager" {
+		t.Errorf("expected manager for arm64, got %q (%v)", image, err)
+	}
+
+	// The override is a single platform image, which has no manifest list to check
+	image, err = resolveImage(context.Background(), runtime, entry, Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	if err != nil || image != "manager:armv7" {
+		t.Errorf("expected the armv7 override, got %q (%v)", image, err)
+	}
+
+	_, err = resolveImage(context.Background(), runtime, entry, Platform{OS: "linux", Architecture: "386"})
+	if err == nil || !strings.Contains(err.Error(), "linux/amd64, linux/arm64") {
+		t.Errorf("expected an error listing the available platforms, got %v", err)
+	}
+
+	_, err = resolveImage(context.Background(), runtime, &CatalogEntry{Platforms: map[string]string{"arm64": "manager"}}, Platform{OS: "linux", Architecture: "amd64"})
+	if err == nil {
+		t.Error("expected an entry without an image for amd64 to fail")
+	}
+}
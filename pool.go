@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// ManagerPool keeps one connection open per running manager, instead of dialing on every config change.
+// Connections reconnect on their own, and are redialed if the manager moves to another port.
+type ManagerPool struct {
+	mu    sync.Mutex
+	dial  ManagerDialer
+	conns map[Service]*pooledManagerConn
+}
+
+type pooledManagerConn struct {
+	target string
+	conn   ManagerConn
+}
+
+func newManagerPool(dial ManagerDialer) *ManagerPool {
+	return &ManagerPool{
+		dial:  dial,
+		conns: map[Service]*pooledManagerConn{},
+	}
+}
+
+// Get returns the connection to the manager of service listening on target, dialing it if needed
+func (pool *ManagerPool) Get(service Service, target string) (ManagerConn, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pooled, found := pool.conns[service]; found {
+		if pooled.target == target {
+			return pooled.conn, nil
+		}
+		// The manager was recreated on another port, the old connection would only ever retry
+		pool.closeLocked(service)
+	}
+
+	conn, err := pool.dial(target)
+	if err != nil {
+		return nil, err
+	}
+	pool.conns[service] = &pooledManagerConn{target: target, conn: conn}
+	return conn, nil
+}
+
+// Remove closes the connection to the manager of service, if there is one
+func (pool *ManagerPool) Remove(service Service) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.closeLocked(service)
+}
+
+// Retain closes the connections to every manager not in services
+func (pool *ManagerPool) Retain(services Services) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	retained := map[Service]bool{}
+	for _, service := range services {
+		retained[service] = true
+	}
+	for service := range pool.conns {
+		if !retained[service] {
+			pool.closeLocked(service)
+		}
+	}
+}
+
+// Close closes every connection
+func (pool *ManagerPool) Close() {
+	pool.Retain(Services{})
+}
+
+func (pool *ManagerPool) closeLocked(service Service) {
+	pooled, found := pool.conns[service]
+	if !found {
+		return
+	}
+	delete(pool.conns, service)
+	if err := pooled.conn.Close(); err != nil {
+		log.Printf("failed to close connection to %s: %v\n", string(service), err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// countingDialer dials a new FakeManagerConn every time, keeping every one it dialed
+type countingDialer struct {
+	dialed []*FakeManagerConn
+	err    error
+}
+
+func (d *countingDialer) Dial(target string) (ManagerConn, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	conn := &FakeManagerConn{Target: target}
+	d.dialed = append(d.dialed, conn)
+	return conn, nil
+}
+
+func TestManagerPoolReusesConnections(t *testing.T) {
+	dialer := &countingDialer{}
+	pool := newManagerPool(dialer.Dial)
+
+	first, err := pool.Get("lb", "127.0.0.1:50001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.Get("lb", "127.0.0.1:50001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || len(dialer.dialed) != 1 {
+		t.Errorf("expected a single connection to be dialed, got %d", len(dialer.dialed))
+	}
+}
+
+func TestManagerPoolRedialsMovedManagers(t *testing.T) {
+	dialer := &countingDialer{}
+	pool := newManagerPool(dialer.Dial)
+
+	pool.Get("lb", "127.0.0.1:50001")
+	conn, err := pool.Get("lb", "127.0.0.1:50002")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dialer.dialed) != 2 || conn.(*FakeManagerConn).Target != "127.0.0.1:50002" {
+		t.Fatalf("expected the new target to be dialed, got %d dials", len(dialer.dialed))
+	}
+	if !dialer.dialed[0].Closed {
+		t.Error("the connection to the old target was not closed")
+	}
+}
+
+func TestManagerPoolRemoveAndRetain(t *testing.T) {
+	dialer := &countingDialer{}
+	pool := newManagerPool(dialer.Dial)
+	pool.Get("lb", "127.0.0.1:50001")
+	pool.Get("dns", "127.0.0.1:50002")
+	pool.Get("vpn", "127.0.0.1:50003")
+	lb, dns, vpn := dialer.dialed[0], dialer.dialed[1], dialer.dialed[2]
+
+	pool.Remove("lb")
+	if !lb.Closed || dns.Closed || vpn.Closed {
+		t.Errorf("expected only lb to be closed, got lb %v, dns %v and vpn %v", lb.Closed, dns.Closed, vpn.Closed)
+	}
+	// Removing a service without a connection is fine
+	pool.Remove("lb")
+
+	pool.Retain(Services{"dns"})
+	if dns.Closed || !vpn.Closed {
+		t.Errorf("expected only vpn to be closed, got dns %v and vpn %v", dns.Closed, vpn.Closed)
+	}
+
+	pool.Get("lb", "127.0.0.1:50001")
+	if len(dialer.dialed) != 4 {
+		t.Errorf("expected a removed service to be dialed again, got %d dials", len(dialer.dialed))
+	}
+
+	pool.Close()
+	if !dns.Closed || !dialer.dialed[3].Closed {
+		t.Error("Close left connections open")
+	}
+}
+
+func TestManagerPoolDialFailure(t *testing.T) {
+	dialer := &countingDialer{err: errors.New("connection refused")}
+	pool := newManagerPool(dialer.Dial)
+
+	if _, err := pool.Get("lb", "127.0.0.1:50001"); err == nil {
+		t.Fatal("expected the dial error")
+	}
+	dialer.err = nil
+	if _, err := pool.Get("lb", "127.0.0.1:50001"); err != nil || len(dialer.dialed) != 1 {
+		t.Errorf("expected the failed dial to be retried, got %v", err)
+	}
+}
+
+func TestSyncClosesConnectionsOfStoppedServices(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	agent.syncStore(t)
+	conn, _ := agent.dialer.Dial(agent.provider.Targets["lb"])
+	if conn.(*FakeManagerConn).Closed {
+		t.Fatal("the connection to lb was closed while it runs")
+	}
+
+	agent.deleteConfig("lb", "backend")
+	agent.syncStore(t)
+
+	if !conn.(*FakeManagerConn).Closed {
+		t.Error("the connection to the stopped lb was left open")
+	}
+}
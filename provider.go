@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/go-connections/nat"
+)
+
+// ServiceProvider runs the managers of services, as docker containers or as host processes
+type ServiceProvider interface {
+	// Start runs the manager of service as described by its catalog entry
+	Start(ctx context.Context, service Service, entry *CatalogEntry) error
+	// Stop stops the manager of service, if it is running
+	Stop(ctx context.Context, service Service) error
+	// Running lists the services whose manager is running
+	Running(ctx context.Context) (Services, error)
+	// Target is the gRPC target the manager of service is reachable on
+	Target(ctx context.Context, service Service) (string, error)
+	// Drift lists what differs between the running manager of service and its catalog entry, nothing if they match
+	Drift(ctx context.Context, service Service, entry *CatalogEntry) ([]string, error)
+}
+
+// newServiceProvider returns the provider named by kind, docker (the default) needs runtime
+func newServiceProvider(kind string, runtime ContainerRuntime) (ServiceProvider, error) {
+	switch kind {
+	case "", "docker":
+		if runtime == nil {
+			return nil, errors.New("no container runtime specified")
+		}
+		return &dockerProvider{runtime: runtime}, nil
+	case "process":
+		supervisor := newSupervisor(processSocketDir, processLogDir())
+		supervisor.killLeftovers()
+		return supervisor, nil
+	default:
+		return nil, fmt.Errorf("unsupported SERVICE_PROVIDER %q, expected docker or process", kind)
+	}
+}
+
+// dockerProvider runs managers as privileged containers sharing the agent's docker daemon
+type dockerProvider struct {
+	runtime ContainerRuntime
+}
+
+// managerContainerName is the name of the container running the manager of service
+func managerContainerName(service Service) string {
+	return "com.opencopilot.service-manager." + string(service)
+}
+
+// managerContainer is the definition of the container running the manager of service from image
+func managerContainer(service Service, entry *CatalogEntry, image string) (*container.Config, *container.HostConfig) {
+	containerConfig := &container.Config{
+		Labels: map[string]string{
+			"com.opencopilot.managed":         "",
+			"com.opencopilot.service-manager": string(service),
+		},
+		Image: image,
+		Env:   append([]string{"CONFIG_DIR=" + ConfigDir, "INSTANCE_ID=" + InstanceID}, managerDockerEnv()...),
+	}
+	exposedPorts, portBindings := entry.portBindings()
+	containerConfig.ExposedPorts = exposedPorts
+
+	hostConfig := &container.HostConfig{
+		AutoRemove: true, // Important to remove container after it's stopped, so that we can start a new one up with the same name if this service gets re-added
+		Privileged: true, // So that the manager containers can start other docker containers,
+		Binds: append(append(managerDockerBinds(), // So that the manager containers have access to the same Docker as the agent
+			ConfigDir+":"+ConfigDir,
+		), entry.volumeBinds(service)...),
+		PortBindings: portBindings,
+		StorageOpt:   entry.Quotas.storageOpt(),
+	}
+	return containerConfig, hostConfig
+}
+
+func (p *dockerProvider) Start(ctx context.Context, service Service, entry *CatalogEntry) error {
+	if entry.Quotas.Egress != "" && remoteDockerDaemon() {
+		// The container's PID belongs to the docker host, nsenter on the agent's host would shape some other process
+		return fmt.Errorf("can't apply the egress quota of %s, the docker daemon at %s isn't local", string(service), dockerHost())
+	}
+
+	platform, err := daemonPlatform(ctx, p.runtime)
+	if err != nil {
+		return err
+	}
+
+	image, err := resolveImage(ctx, p.runtime, entry, platform)
+	if err != nil {
+		return err
+	}
+
+	containerConfig, hostConfig := managerContainer(service, entry, image)
+
+	reader, err := p.runtime.ImagePull(ctx, containerConfig.Image, dockerTypes.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		log.Panic(err)
+	}
+
+	if err := p.ensureVolumes(ctx, service, entry); err != nil {
+		return err
+	}
+
+	res, err := p.runtime.ContainerCreate(ctx, containerConfig, hostConfig, nil, managerContainerName(service))
+	if err != nil {
+		return err
+	}
+
+	if err := copyDockerCerts(ctx, p.runtime, res.ID); err != nil {
+		p.runtime.ContainerRemove(ctx, res.ID, dockerTypes.ContainerRemoveOptions{Force: true})
+		return fmt.Errorf("failed to copy docker certificates into the manager of %s: %v", string(service), err)
+	}
+
+	startErr := p.runtime.ContainerStart(ctx, res.ID, dockerTypes.ContainerStartOptions{})
+	if startErr != nil {
+		return startErr
+	}
+
+	if err := p.applyEgressQuota(ctx, res.ID, &entry.Quotas); err != nil {
+		// An unshaped manager is what quotas are meant to prevent, so don't leave it running
+		p.runtime.ContainerStop(ctx, res.ID, nil)
+		return fmt.Errorf("failed to apply egress quota to %s: %v", string(service), err)
+	}
+
+	return nil
+}
+
+// managerContainers lists the running containers of the manager of service
+func (p *dockerProvider) managerContainers(ctx context.Context, service Service) ([]dockerTypes.Container, error) {
+	args := filters.NewArgs(
+		filters.Arg("label", "com.opencopilot.managed"),
+		filters.Arg("name", managerContainerName(service)),
+	)
+	return p.runtime.ContainerList(ctx, dockerTypes.ContainerListOptions{
+		Filters: args,
+	})
+}
+
+func (p *dockerProvider) Stop(ctx context.Context, service Service) error {
+	containers, err := p.managerContainers(ctx, service)
+	if err != nil {
+		return err
+	}
+	for _, managed := range containers {
+		if err := p.stopContainer(ctx, managed.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopContainer stops a manager and waits for docker to auto-remove it, as only then is its name free for a new one
+func (p *dockerProvider) stopContainer(ctx context.Context, containerID string) error {
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	removedC, errC := p.runtime.ContainerWait(waitCtx, containerID, container.WaitConditionRemoved)
+	if err := p.runtime.ContainerStop(ctx, containerID, nil); err != nil {
+		return err
+	}
+	select {
+	case <-removedC:
+	case <-errC:
+		// Most likely the container is gone already
+	}
+	return nil
+}
+
+func (p *dockerProvider) Drift(ctx context.Context, service Service, entry *CatalogEntry) ([]string, error) {
+	containers, err := p.managerContainers(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("service %s is not running", string(service))
+	}
+	info, err := p.runtime.ContainerInspect(ctx, containers[0].ID)
+	if err != nil {
+		return nil, err
+	}
+
+	platform, err := daemonPlatform(ctx, p.runtime)
+	if err != nil {
+		return nil, err
+	}
+	desired, desiredHost := managerContainer(service, entry, entry.ImageFor(platform))
+
+	drift := []string{}
+	if info.Config == nil || info.Config.Image != desired.Image {
+		drift = append(drift, "image")
+	}
+	// The image adds env and labels of its own, so only what the agent sets is compared
+	if info.Config == nil || !containsAll(info.Config.Env, desired.Env) {
+		drift = append(drift, "env")
+	}
+	if info.Config == nil || !containsLabels(info.Config.Labels, desired.Labels) {
+		drift = append(drift, "labels")
+	}
+	if info.HostConfig == nil || !sameSet(info.HostConfig.Binds, desiredHost.Binds) {
+		drift = append(drift, "mounts")
+	}
+	if info.HostConfig == nil || !samePortBindings(info.HostConfig.PortBindings, desiredHost.PortBindings) {
+		drift = append(drift, "ports")
+	}
+	if info.HostConfig == nil || !sameOptions(info.HostConfig.StorageOpt, desiredHost.StorageOpt) {
+		drift = append(drift, "storage")
+	}
+	return drift, nil
+}
+
+// containsAll reports whether every item of want is in have
+func containsAll(have []string, want []string) bool {
+	haveSet := map[string]bool{}
+	for _, item := range have {
+		haveSet[item] = true
+	}
+	for _, item := range want {
+		if !haveSet[item] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameSet(a []string, b []string) bool {
+	return containsAll(a, b) && containsAll(b, a)
+}
+
+// samePortBindings reports whether a and b publish the same ports the same way, a port without bindings counting
+// as unpublished
+func samePortBindings(a nat.PortMap, b nat.PortMap) bool {
+	published := func(bindings nat.PortMap) map[string]bool {
+		set := map[string]bool{}
+		for port, portBindings := range bindings {
+			for _, binding := range portBindings {
+				set[string(port)+"="+binding.HostIP+":"+binding.HostPort] = true
+			}
+		}
+		return set
+	}
+	aSet, bSet := published(a), published(b)
+	if len(aSet) != len(bSet) {
+		return false
+	}
+	for binding := range aSet {
+		if !bSet[binding] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameOptions reports whether a and b hold the same options, nil and empty being the same
+func sameOptions(a map[string]string, b map[string]string) bool {
+	return len(a) == len(b) && containsLabels(a, b)
+}
+
+// containsLabels reports whether have carries every label of want with the same value
+func containsLabels(have map[string]string, want map[string]string) bool {
+	for key, value := range want {
+		if actual, found := have[key]; !found || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *dockerProvider) Running(ctx context.Context) (Services, error) {
+	args := filters.NewArgs(
+		filters.Arg("label", "com.opencopilot.managed"),
+	)
+	containers, err := p.runtime.ContainerList(ctx, dockerTypes.ContainerListOptions{
+		Filters: args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	localServices := Services{}
+	for _, container := range containers {
+		serviceName, found := container.Labels["com.opencopilot.service-manager"]
+		if !found {
+			continue
+		}
+		localServices = append(localServices, Service(serviceName))
+	}
+	return localServices, nil
+}
+
+// Target is the port docker published the manager's gRPC port on, at managerGRPCHost
+func (p *dockerProvider) Target(ctx context.Context, service Service) (string, error) {
+	containers, err := p.managerContainers(ctx, service)
+	if err != nil {
+		return "", err
+	}
+
+	for _, container := range containers {
+		for _, portPair := range container.Ports {
+			if portPair.PrivatePort == managerGRPCPort {
+				return net.JoinHostPort(managerGRPCHost(), strconv.Itoa(int(portPair.PublicPort))), nil
+			}
+		}
+	}
+
+	return "", errors.New("Could not find gRPC port")
+}
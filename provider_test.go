@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+)
+
+func TestDockerProviderDrift(t *testing.T) {
+	defer withDockerConfig("unix:///var/run/docker.sock", "", false)()
+	entry := &CatalogEntry{
+		Image:   "quay.io/opencopilot/haproxy-manager",
+		Ports:   []nat.Port{"80/tcp"},
+		Quotas:  Quotas{Storage: "2G"},
+		Volumes: []*Volume{{Name: "state", Path: "/var/lib/haproxy"}},
+	}
+	provider := &dockerProvider{runtime: NewFakeContainerRuntime()}
+	if err := provider.Start(context.Background(), "lb", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err := provider.Drift(context.Background(), "lb", entry)
+	if err != nil || len(drift) != 0 {
+		t.Fatalf("expected no drift, got %v (%v)", drift, err)
+	}
+
+	cases := []struct {
+		change   func(entry *CatalogEntry)
+		expected []string
+	}{
+		{func(entry *CatalogEntry) { entry.Image = "quay.io/opencopilot/haproxy-manager:v2" }, []string{"image"}},
+		{func(entry *CatalogEntry) { entry.Ports = []nat.Port{"80/tcp", "443/tcp"} }, []string{"ports"}},
+		{func(entry *CatalogEntry) { entry.Ports = nil }, []string{"ports"}},
+		{func(entry *CatalogEntry) { entry.Quotas.Storage = "4G" }, []string{"storage"}},
+		{func(entry *CatalogEntry) { entry.Quotas.Storage = "" }, []string{"storage"}},
+		{func(entry *CatalogEntry) { entry.Volumes[0].Path = "/data" }, []string{"mounts"}},
+		// The egress quota is applied after the container starts, it isn't part of the definition
+		{func(entry *CatalogEntry) { entry.Quotas.Egress = "10mbit" }, []string{}},
+	}
+	for _, c := range cases {
+		changed := *entry
+		changed.Ports = append([]nat.Port{}, entry.Ports...)
+		changed.Volumes = []*Volume{{Name: "state", Path: "/var/lib/haproxy"}}
+		c.change(&changed)
+
+		drift, err := provider.Drift(context.Background(), "lb", &changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(drift, c.expected) {
+			t.Errorf("expected %v to drift, got %v", c.expected, drift)
+		}
+	}
+}
+
+func TestDockerProviderDriftOfStoppedService(t *testing.T) {
+	provider := &dockerProvider{runtime: NewFakeContainerRuntime()}
+	if _, err := provider.Drift(context.Background(), "lb", &CatalogEntry{Image: "manager"}); err == nil {
+		t.Error("expected a service that isn't running to fail")
+	}
+}
+
+func TestSamePortBindings(t *testing.T) {
+	published := nat.PortMap{"80/tcp": {{HostPort: "80"}}}
+	if !samePortBindings(published, nat.PortMap{"80/tcp": {{HostPort: "80"}}}) {
+		t.Error("expected identical bindings to match")
+	}
+	// Docker may report exposed ports without bindings, they aren't published
+	if !samePortBindings(nat.PortMap{"80/tcp": {{HostPort: "80"}}, "8080/tcp": {}}, published) {
+		t.Error("expected a port without bindings to be ignored")
+	}
+	if samePortBindings(published, nat.PortMap{"80/tcp": {{HostIP: "127.0.0.1", HostPort: "80"}}}) {
+		t.Error("expected a different host IP not to match")
+	}
+	if samePortBindings(published, nat.PortMap{"80/tcp": {{HostPort: "8080"}}}) {
+		t.Error("expected a different host port not to match")
+	}
+	if !samePortBindings(nil, nat.PortMap{}) {
+		t.Error("expected nil and empty bindings to match")
+	}
+}
+
+func TestSameOptions(t *testing.T) {
+	if !sameOptions(nil, map[string]string{}) {
+		t.Error("expected nil and empty options to match")
+	}
+	if sameOptions(map[string]string{"size": "2G"}, nil) {
+		t.Error("expected options and no options not to match")
+	}
+	if sameOptions(map[string]string{"size": "2G"}, map[string]string{"size": "4G"}) {
+		t.Error("expected different values not to match")
+	}
+}
+
+func TestSyncRecreatesDriftedServices(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	agent.syncStore(t)
+
+	// Only the catalog changes, the config stays the same
+	if err := ioutil.WriteFile(CatalogPath, []byte(`lb: {image: "quay.io/opencopilot/haproxy-manager", ports: ["443/tcp"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	agent.syncStore(t)
+
+	if ports := agent.provider.Services["lb"].Ports; !reflect.DeepEqual(ports, []nat.Port{"443/tcp"}) {
+		t.Errorf("lb was not recreated, it publishes %v", ports)
+	}
+	if !reflect.DeepEqual(agent.firewall.Open, []nat.Port{"443/tcp"}) {
+		t.Errorf("expected port 443/tcp to be open, got %v", agent.firewall.Open)
+	}
+	if configs := agent.configs("lb"); len(configs) != 2 {
+		t.Errorf("recreated lb was not sent its config: %v", configs)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	units "github.com/docker/go-units"
+)
+
+// tcRate matches the rates tc understands, e.g. 512kbit or 10mbit
+var tcRate = regexp.MustCompile(`^([0-9]+(\.[0-9]+)?)([kmgt]?)(bit|bps)$`)
+
+var tcRatePrefixes = map[string]float64{"": 1, "k": 1e3, "m": 1e6, "g": 1e9, "t": 1e12}
+
+const (
+	// tcHZ is the lowest timer frequency kernels are built with, tbf releases a burst's worth of bytes per tick
+	tcHZ = 100
+	// tbfMinBurst keeps the burst above the MTU at low rates
+	tbfMinBurst = 4096
+)
+
+// Quotas bound the resources a service may use, so one manager can't exhaust a small device
+type Quotas struct {
+	// Storage caps the container's writable layer, e.g. "2G", it needs a storage driver with quota support like overlay2 on xfs with pquota.
+	// Volumes are outside the writable layer and have a size of their own.
+	Storage string `yaml:"storage"`
+	// Egress shapes the container's outgoing bandwidth with tc, e.g. "10mbit"
+	Egress string `yaml:"egress"`
+}
+
+func (quotas *Quotas) validate() error {
+	if quotas.Storage != "" {
+		if _, err := units.RAMInBytes(quotas.Storage); err != nil {
+			return fmt.Errorf("invalid storage quota %q: %v", quotas.Storage, err)
+		}
+	}
+	if quotas.Egress != "" && !tcRate.MatchString(quotas.Egress) {
+		return fmt.Errorf("invalid egress quota %q, expected a rate like 10mbit", quotas.Egress)
+	}
+	return nil
+}
+
+// storageOpt is the docker storage option enforcing the storage quota
+func (quotas *Quotas) storageOpt() map[string]string {
+	if quotas.Storage == "" {
+		return nil
+	}
+	return map[string]string{"size": quotas.Storage}
+}
+
+// applyEgressQuota shapes the outgoing traffic of a running container by replacing the root qdisc of eth0 in its
+// network namespace with a token bucket filter
+func (p *dockerProvider) applyEgressQuota(ctx context.Context, containerID string, quotas *Quotas) error {
+	if quotas.Egress == "" {
+		return nil
+	}
+
+	info, err := p.runtime.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	if info.State == nil || info.State.Pid == 0 {
+		return fmt.Errorf("container %s is not running", containerID)
+	}
+
+	burst, err := tbfBurst(quotas.Egress)
+	if err != nil {
+		return err
+	}
+	return runCommand("", "nsenter", "-t", strconv.Itoa(info.State.Pid), "-n",
+		"tc", "qdisc", "replace", "dev", "eth0", "root", "tbf", "rate", quotas.Egress, "burst", strconv.Itoa(burst), "latency", "400ms")
+}
+
+// tbfBurst is the bucket size in bytes for a tbf shaping at rate. The bucket has to hold at least what rate allows
+// per timer tick, or the rate can't be reached.
+func tbfBurst(rate string) (int, error) {
+	match := tcRate.FindStringSubmatch(rate)
+	if match == nil {
+		return 0, fmt.Errorf("invalid rate %q", rate)
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	bytesPerSecond := value * tcRatePrefixes[match[3]]
+	if match[4] == "bit" {
+		bytesPerSecond /= 8
+	}
+	burst := int(bytesPerSecond / tcHZ)
+	if burst < tbfMinBurst {
+		burst = tbfMinBurst
+	}
+	return burst, nil
+}
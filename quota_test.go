@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestQuotasValidate(t *testing.T) {
+	valid := []Quotas{
+		{},
+		{Storage: "2G", Egress: "10mbit"},
+		{Egress: "1.5mbps"},
+		{Egress: "512kbit"},
+	}
+	for _, quotas := range valid {
+		if err := quotas.validate(); err != nil {
+			t.Errorf("expected %+v to be valid, got %v", quotas, err)
+		}
+	}
+
+	invalid := []Quotas{
+		{Storage: "lots"},
+		{Egress: "10"},
+		{Egress: "10 mbit"},
+		{Egress: "fast"},
+	}
+	for _, quotas := range invalid {
+		if err := quotas.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", quotas)
+		}
+	}
+}
+
+func TestTbfBurst(t *testing.T) {
+	cases := map[string]int{
+		"10mbit":  12500,
+		"1gbit":   1250000,
+		"1mbps":   10000,
+		"4.8mbit": 6000,
+		// Low rates get a burst that still fits a full packet
+		"512kbit": tbfMinBurst,
+		"100bit":  tbfMinBurst,
+	}
+	for rate, expected := range cases {
+		burst, err := tbfBurst(rate)
+		if err != nil {
+			t.Errorf("%s: %v", rate, err)
+			continue
+		}
+		if burst != expected {
+			t.Errorf("expected a burst of %d for %s, got %d", expected, rate, burst)
+		}
+	}
+
+	if _, err := tbfBurst("fast"); err == nil {
+		t.Error("expected an invalid rate to fail")
+	}
+}
+
+func TestStorageOpt(t *testing.T) {
+	if opt := (&Quotas{}).storageOpt(); opt != nil {
+		t.Errorf("expected no storage option, got %v", opt)
+	}
+	if opt := (&Quotas{Storage: "2G"}).storageOpt(); !reflect.DeepEqual(opt, map[string]string{"size": "2G"}) {
+		t.Errorf("unexpected storage option %v", opt)
+	}
+}
+
+func TestApplyEgressQuota(t *testing.T) {
+	dir, restore := withFakeCommands(t, map[string]string{"nsenter": "exit 0"})
+	defer restore()
+
+	runtime := NewFakeContainerRuntime()
+	provider := &dockerProvider{runtime: runtime}
+	res, err := runtime.ContainerCreate(context.Background(), &container.Config{Image: "manager"}, &container.HostConfig{}, nil, "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := provider.applyEgressQuota(context.Background(), res.ID, &Quotas{Egress: "10mbit"}); err == nil {
+		t.Error("expected a container that isn't running to fail")
+	}
+
+	if err := runtime.ContainerStart(context.Background(), res.ID, dockerTypes.ContainerStartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.applyEgressQuota(context.Background(), res.ID, &Quotas{Egress: "10mbit"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "-t 1000 -n tc qdisc replace dev eth0 root tbf rate 10mbit burst 12500 latency 400ms"
+	if command := strings.TrimSpace(readCommandLog(t, dir, "nsenter")); command != expected {
+		t.Errorf("unexpected tc command %q", command)
+	}
+}
+
+func TestVolumeSize(t *testing.T) {
+	if err := (&Volume{Name: "state", Path: "/var/lib/state", Size: "huge"}).validate(); err == nil {
+		t.Error("expected an invalid volume size to be refused")
+	}
+
+	runtime := NewFakeContainerRuntime()
+	provider := &dockerProvider{runtime: runtime}
+	entry := &CatalogEntry{Volumes: []*Volume{
+		{Name: "state", Path: "/var/lib/state", Size: "1G"},
+		{Name: "cache", Path: "/var/cache"},
+	}}
+	if err := provider.ensureVolumes(context.Background(), "lb", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if options := runtime.Volumes["opencopilot-lb-state"].Options; !reflect.DeepEqual(options, map[string]string{"size": "1G"}) {
+		t.Errorf("unexpected options for the sized volume: %v", options)
+	}
+	if options := runtime.Volumes["opencopilot-lb-cache"].Options; len(options) != 0 {
+		t.Errorf("unexpected options for the unsized volume: %v", options)
+	}
+}
@@ -3,26 +3,81 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
+	"io"
+	"time"
 
 	pb "github.com/opencopilot/agent/agent"
 	pbHealth "github.com/opencopilot/agent/health"
 
 	dockerTypes "github.com/docker/docker/api/types"
-	docker "github.com/docker/docker/client"
-	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type server struct {
-	dockerCli *docker.Client
-	consulCli *consul.Client
+	runtime     ContainerRuntime
+	provider    ServiceProvider
+	configStore ConfigStore
+	managers    *ManagerPool
+	firewall    Firewall
+	registry    ServiceRegistry
+	federation  *Federation
+	status      *StatusReporter
+	maintenance *Maintenance
+	snapshot    *ConfigSnapshot
 }
 
 type health struct{}
 
+var errNoRuntime = errors.New("docker is disabled, managers run as host processes")
+
+var errNoFederation = status.Error(codes.FailedPrecondition, "peer federation is disabled, set SITE_ID to enable it")
+
+// newServer builds the server shared by the public and private gRPC endpoints. runtime is nil when managers run
+// as host processes, firewall and federation are optional.
+func newServer(runtime ContainerRuntime, provider ServiceProvider, configStore ConfigStore, registry ServiceRegistry, dialManager ManagerDialer, firewall Firewall, federation *Federation) (*server, error) {
+	if provider == nil {
+		return nil, errors.New("no service provider specified")
+	}
+	if configStore == nil {
+		return nil, errors.New("no config store specified")
+	}
+	if registry == nil {
+		return nil, errors.New("no service registry specified")
+	}
+	if dialManager == nil {
+		return nil, errors.New("no manager dialer specified")
+	}
+	maintenance, err := loadMaintenance(maintenanceFile())
+	if err != nil {
+		return nil, err
+	}
+	return &server{
+		runtime:     runtime,
+		provider:    provider,
+		configStore: configStore,
+		managers:    newManagerPool(dialManager),
+		firewall:    firewall,
+		registry:    registry,
+		federation:  federation,
+		status:      newStatusReporter(configStore),
+		maintenance: maintenance,
+		snapshot:    newConfigSnapshot(),
+	}, nil
+}
+
 func (s *server) ToAgent() *Agent {
 	return &Agent{
-		dockerCli: s.dockerCli,
-		consulCli: s.consulCli,
+		runtime:     s.runtime,
+		provider:    s.provider,
+		configStore: s.configStore,
+		managers:    s.managers,
+		firewall:    s.firewall,
+		registry:    s.registry,
+		status:      s.status,
+		maintenance: s.maintenance,
+		snapshot:    s.snapshot,
 	}
 }
 
@@ -33,13 +88,32 @@ func (s *server) Check(ctx context.Context, in *pbHealth.HealthCheckRequest) (*p
 }
 
 func (s *server) GetStatus(ctx context.Context, in *pb.AgentStatusRequest) (*pb.AgentStatus, error) {
+	if in.InstanceId != "" && in.InstanceId != InstanceID {
+		if s.federation == nil {
+			return nil, errNoFederation
+		}
+		return s.federation.forwardGetStatus(ctx, in)
+	}
 	agent := s.ToAgent()
 	return agent.AgentGetStatus(ctx)
 }
 
 func (s *server) GetServiceLogs(in *pb.GetServiceLogsRequest, stream pb.Agent_GetServiceLogsServer) error {
-	options := dockerTypes.ContainerLogsOptions{ShowStderr: true}
-	out, err := s.dockerCli.ContainerLogs(context.Background(), in.ContainerId, options)
+	if in.InstanceId != "" && in.InstanceId != InstanceID {
+		if s.federation == nil {
+			return errNoFederation
+		}
+		return s.federation.forwardGetServiceLogs(in, stream)
+	}
+	var out io.ReadCloser
+	var err error
+	if supervisor, ok := s.provider.(*Supervisor); ok {
+		// Host processes have no container, container_id names the service instead
+		out, err = supervisor.Logs(Service(in.ContainerId))
+	} else {
+		options := dockerTypes.ContainerLogsOptions{ShowStderr: true}
+		out, err = s.runtime.ContainerLogs(context.Background(), in.ContainerId, options)
+	}
 	if err != nil {
 		return err
 	}
@@ -57,3 +131,71 @@ func (s *server) GetServiceLogs(in *pb.GetServiceLogsRequest, stream pb.Agent_Ge
 
 	return nil
 }
+
+func (s *server) CheckRuntime(ctx context.Context, in *pb.RuntimeCheckRequest) (*pb.RuntimeCheck, error) {
+	check := &pb.RuntimeCheck{Host: dockerHost()}
+	if s.runtime == nil {
+		check.Error = errNoRuntime.Error()
+		return check, nil
+	}
+	ping, err := s.runtime.Ping(ctx)
+	if err != nil {
+		check.Error = err.Error()
+		return check, nil
+	}
+	check.Reachable = true
+	check.ApiVersion = ping.APIVersion
+	check.OsType = ping.OSType
+	return check, nil
+}
+
+func (s *server) GetSiteStatus(ctx context.Context, in *pb.SiteStatusRequest) (*pb.SiteStatus, error) {
+	if s.federation == nil {
+		return nil, errNoFederation
+	}
+	site := in.SiteId
+	if site == "" {
+		site = SiteID
+	}
+	return s.federation.siteStatus(ctx, site, s.ToAgent().AgentGetStatus)
+}
+
+func toReconciliationState(state maintenanceState) *pb.ReconciliationState {
+	reconciliationState := &pb.ReconciliationState{Paused: state.Paused, Reason: state.Reason}
+	if state.Paused {
+		reconciliationState.PausedSince = state.Since.Unix()
+	}
+	return reconciliationState
+}
+
+func (s *server) PauseReconciliation(ctx context.Context, in *pb.PauseReconciliationRequest) (*pb.ReconciliationState, error) {
+	state, err := s.maintenance.Pause(in.Reason)
+	if err != nil {
+		return nil, err
+	}
+	return toReconciliationState(state), nil
+}
+
+func (s *server) ResumeReconciliation(ctx context.Context, in *pb.ResumeReconciliationRequest) (*pb.ReconciliationState, error) {
+	state, err := s.maintenance.Resume()
+	if err != nil {
+		return nil, err
+	}
+	return toReconciliationState(state), nil
+}
+
+func (s *server) Drain(in *pb.DrainRequest, stream pb.Agent_DrainServer) error {
+	timeout := defaultDrainTimeout
+	if in.TimeoutSeconds > 0 {
+		timeout = time.Duration(in.TimeoutSeconds) * time.Second
+	}
+	return s.ToAgent().drain(stream.Context(), timeout, in.Deregister, stream.Send)
+}
+
+func (s *server) ListVolumes(ctx context.Context, in *pb.ListVolumesRequest) (*pb.VolumeList, error) {
+	volumes, err := s.ToAgent().listVolumes(ctx)
+	if err == errNoRuntime {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return volumes, err
+}
@@ -0,0 +1,47 @@
+package main
+
+import "sync"
+
+// ConfigSnapshot remembers the hash of the config last applied to each service, so a change to one service's config
+// only reconfigures that service instead of every service on the device
+type ConfigSnapshot struct {
+	mu      sync.Mutex
+	applied map[Service]string
+}
+
+func newConfigSnapshot() *ConfigSnapshot {
+	return &ConfigSnapshot{applied: map[Service]string{}}
+}
+
+// Changed reports whether hash differs from the hash of the config last applied to service, or none was applied
+func (snapshot *ConfigSnapshot) Changed(service Service, hash string) bool {
+	snapshot.mu.Lock()
+	defer snapshot.mu.Unlock()
+
+	applied, found := snapshot.applied[service]
+	return !found || applied != hash
+}
+
+// Applied records that the config with hash was applied to service
+func (snapshot *ConfigSnapshot) Applied(service Service, hash string) {
+	snapshot.mu.Lock()
+	defer snapshot.mu.Unlock()
+
+	snapshot.applied[service] = hash
+}
+
+// Forget drops service, so it is configured again on the next sync
+func (snapshot *ConfigSnapshot) Forget(service Service) {
+	snapshot.mu.Lock()
+	defer snapshot.mu.Unlock()
+
+	delete(snapshot.applied, service)
+}
+
+// Reset forgets every service, so the next sync reconciles everything
+func (snapshot *ConfigSnapshot) Reset() {
+	snapshot.mu.Lock()
+	defer snapshot.mu.Unlock()
+
+	snapshot.applied = map[Service]string{}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// ServiceStatus is the outcome of the last attempt to apply a service's config
+type ServiceStatus struct {
+	ConfigHash string `json:"config_hash"`
+	// AppliedAt is when the config was applied, unset if it failed to apply
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	Success   bool       `json:"success"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// serviceStatusKey is where the status of a service is written, in the service's config subtree where the control
+// plane looks for it. withoutStatusKeys keeps it out of the config the agent watches, hashes and sends.
+func serviceStatusKey(service Service) string {
+	return "instances/" + InstanceID + "/services/" + string(service) + "/status"
+}
+
+// isServiceStatusKey reports whether key is the status of a service rather than part of its config
+func isServiceStatusKey(key string) bool {
+	prefix := "instances/" + InstanceID + "/services/"
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(key, prefix), "/")
+	return len(parts) == 2 && parts[1] == "status"
+}
+
+// withoutStatusKeys returns kvs without the services' status, leaving only their config
+func withoutStatusKeys(kvs consul.KVPairs) consul.KVPairs {
+	config := consul.KVPairs{}
+	for _, kv := range kvs {
+		if !isServiceStatusKey(kv.Key) {
+			config = append(config, kv)
+		}
+	}
+	return config
+}
+
+func configHash(config []byte) string {
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:])
+}
+
+// kvsHash is the hash of the keys and values of kvs, which only changes with them
+func kvsHash(kvs consul.KVPairs) string {
+	hash := sha256.New()
+	for _, kv := range kvs {
+		hash.Write([]byte(kv.Key))
+		hash.Write([]byte{0})
+		hash.Write(kv.Value)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// StatusReporter writes the apply status of each service back to Consul KV, so the control plane can tell whether
+// a pushed config landed without asking every agent
+type StatusReporter struct {
+	mu    sync.Mutex
+	store ConfigStore
+	last  map[Service]ServiceStatus
+}
+
+func newStatusReporter(store ConfigStore) *StatusReporter {
+	return &StatusReporter{
+		store: store,
+		last:  map[Service]ServiceStatus{},
+	}
+}
+
+// Report writes the status of applying the config with hash to service. Unchanged statuses aren't rewritten,
+// so retries of the same config don't write to Consul every time.
+func (reporter *StatusReporter) Report(service Service, hash string, applyErr error) {
+	serviceStatus := ServiceStatus{ConfigHash: hash, Success: applyErr == nil}
+	if applyErr != nil {
+		serviceStatus.Error = applyErr.Error()
+	} else {
+		appliedAt := time.Now().UTC()
+		serviceStatus.AppliedAt = &appliedAt
+	}
+
+	reporter.mu.Lock()
+	defer reporter.mu.Unlock()
+
+	if last, found := reporter.last[service]; found &&
+		last.ConfigHash == serviceStatus.ConfigHash && last.Success == serviceStatus.Success && last.Error == serviceStatus.Error {
+		return
+	}
+
+	value, err := json.Marshal(serviceStatus)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if _, err := reporter.store.Put(&consul.KVPair{Key: serviceStatusKey(service), Value: value}, nil); err != nil {
+		log.Printf("failed to write status of %s: %v\n", string(service), err)
+		return
+	}
+	reporter.last[service] = serviceStatus
+}
+
+// Clear removes the status of a service that stopped
+func (reporter *StatusReporter) Clear(service Service) {
+	reporter.mu.Lock()
+	defer reporter.mu.Unlock()
+
+	if _, err := reporter.store.Delete(serviceStatusKey(service), nil); err != nil {
+		log.Printf("failed to clear status of %s: %v\n", string(service), err)
+		return
+	}
+	delete(reporter.last, service)
+}
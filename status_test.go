@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// readStatus returns the status written for service, nil if there is none
+func readStatus(t *testing.T, store *FakeConfigStore, service Service) *ServiceStatus {
+	kvs, _, err := store.List(serviceStatusKey(service), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range kvs {
+		if kv.Key != serviceStatusKey(service) {
+			continue
+		}
+		serviceStatus := &ServiceStatus{}
+		if err := json.Unmarshal(kv.Value, serviceStatus); err != nil {
+			t.Fatal(err)
+		}
+		return serviceStatus
+	}
+	return nil
+}
+
+func TestServiceStatusKey(t *testing.T) {
+	defer withInstanceID("test-instance")()
+
+	if key := serviceStatusKey("lb"); key != "instances/test-instance/services/lb/status" {
+		t.Errorf("unexpected key %s", key)
+	}
+
+	statusKeys := map[string]bool{
+		"instances/test-instance/services/lb/status":        true,
+		"instances/test-instance/services/lb/backend":       false,
+		"instances/test-instance/services/lb/status/detail": false,
+		"instances/test-instance/services/status":           false,
+		"instances/other-instance/services/lb/status":       false,
+	}
+	for key, isStatus := range statusKeys {
+		if isServiceStatusKey(key) != isStatus {
+			t.Errorf("expected %s to be a status key: %v", key, isStatus)
+		}
+	}
+}
+
+func TestWithoutStatusKeys(t *testing.T) {
+	defer withInstanceID("test-instance")()
+	config := consul.KVPairs{{Key: "instances/test-instance/services/lb/backend", Value: []byte("10.0.0.1")}}
+	withStatus := append(config, &consul.KVPair{Key: serviceStatusKey("lb"), Value: []byte(`{"success":true}`)})
+
+	if filtered := withoutStatusKeys(withStatus); len(filtered) != 1 || filtered[0].Key != config[0].Key {
+		t.Errorf("unexpected pairs %v", filtered)
+	}
+	// Writing a status doesn't change the watched tree
+	if kvsHash(withoutStatusKeys(withStatus)) != kvsHash(config) {
+		t.Error("the status changed the hash of the config tree")
+	}
+	changed := consul.KVPairs{{Key: "instances/test-instance/services/lb/backend", Value: []byte("10.0.0.2")}}
+	if kvsHash(changed) == kvsHash(config) {
+		t.Error("a config change didn't change the hash of the config tree")
+	}
+}
+
+func TestStatusReporter(t *testing.T) {
+	defer withInstanceID("test-instance")()
+	store := &FakeConfigStore{}
+	reporter := newStatusReporter(store)
+
+	reporter.Report("lb", "hash-1", nil)
+	serviceStatus := readStatus(t, store, "lb")
+	if serviceStatus == nil || !serviceStatus.Success || serviceStatus.ConfigHash != "hash-1" || serviceStatus.AppliedAt == nil {
+		t.Fatalf("unexpected status %+v", serviceStatus)
+	}
+
+	reporter.Report("lb", "hash-2", errors.New("invalid config"))
+	serviceStatus = readStatus(t, store, "lb")
+	if serviceStatus.Success || serviceStatus.Error != "invalid config" || serviceStatus.ConfigHash != "hash-2" {
+		t.Errorf("unexpected status %+v", serviceStatus)
+	}
+	if serviceStatus.AppliedAt != nil {
+		t.Errorf("a failed apply was stamped with %s", serviceStatus.AppliedAt)
+	}
+
+	reporter.Clear("lb")
+	if serviceStatus := readStatus(t, store, "lb"); serviceStatus != nil {
+		t.Errorf("expected the status to be cleared, got %+v", serviceStatus)
+	}
+}
+
+func TestStatusReporterSkipsUnchangedStatuses(t *testing.T) {
+	defer withInstanceID("test-instance")()
+	store := &FakeConfigStore{}
+	reporter := newStatusReporter(store)
+
+	reporter.Report("lb", "hash-1", errors.New("unavailable"))
+	_, meta, _ := store.List("", nil)
+	reporter.Report("lb", "hash-1", errors.New("unavailable"))
+	_, after, _ := store.List("", nil)
+
+	if after.LastIndex != meta.LastIndex {
+		t.Error("an unchanged status was written again")
+	}
+}
+
+func TestSyncIgnoresStatusKeys(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	agent.setConfig("lb", "backend", "10.0.0.1")
+	agent.syncStore(t)
+
+	// The status written by the first sync is part of the tree the next sync gets
+	kvs, _, _ := agent.store.List("instances/"+InstanceID, &consul.QueryOptions{})
+	written := false
+	for _, kv := range kvs {
+		written = written || kv.Key == serviceStatusKey("lb")
+	}
+	if !written {
+		t.Fatal("no status was written")
+	}
+	agent.sync(kvs)
+
+	if running, _ := agent.provider.Running(context.Background()); len(running) != 1 {
+		t.Errorf("expected only lb to run, got %v", running)
+	}
+	if configs := agent.configs("lb"); len(configs) != 1 {
+		t.Errorf("lb was configured again: %v", configs)
+	}
+
+	// A config change sends the config without the status
+	agent.setConfig("lb", "backend", "10.0.0.2")
+	agent.syncStore(t)
+	if configs := agent.configs("lb"); len(configs) != 2 || configs[1] != `{"backend":"10.0.0.2"}` {
+		t.Errorf("unexpected configs %v", configs)
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// processSocketDir is where managers run as host processes serve gRPC, on a unix socket named after their service.
+	// Their pid files are kept next to the sockets.
+	processSocketDir   = "/run/opencopilot"
+	processStopTimeout = 10 * time.Second
+	// processLogMaxSize is how large the log of a process grows before it is moved aside to <service>.log.1
+	processLogMaxSize = 10 * 1024 * 1024
+	// A process that stayed up this long is considered healthy again, and restarts without waiting
+	processHealthyAfter    = time.Minute
+	processRestartDelay    = time.Second
+	processRestartMaxDelay = time.Minute
+)
+
+// RestartPolicy is when a supervised process is restarted after it exits
+type RestartPolicy string
+
+const (
+	// RestartAlways restarts the process whenever it exits
+	RestartAlways RestartPolicy = "always"
+	// RestartOnFailure only restarts the process when it exits with an error
+	RestartOnFailure RestartPolicy = "on-failure"
+	// RestartNever leaves the process stopped once it exits
+	RestartNever RestartPolicy = "never"
+)
+
+// ProcessSpec runs a manager as a host process, for devices without docker
+type ProcessSpec struct {
+	Command []string          `yaml:"command"`
+	Env     map[string]string `yaml:"env"`
+	Restart RestartPolicy     `yaml:"restart"`
+}
+
+func (spec *ProcessSpec) validate() error {
+	if len(spec.Command) == 0 {
+		return errors.New("process has no command")
+	}
+	switch spec.Restart {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return fmt.Errorf("invalid process restart %q, expected always, on-failure or never", spec.Restart)
+	}
+	return nil
+}
+
+// processLogDir is where the output of supervised processes is kept
+func processLogDir() string {
+	return filepath.Join(ConfigDir, "logs")
+}
+
+// Supervisor is the ServiceProvider running managers as host processes. A manager is told where to serve gRPC
+// by MANAGER_SOCKET, and its output is appended to a log file named after its service.
+type Supervisor struct {
+	mu        sync.Mutex
+	socketDir string
+	logDir    string
+	processes map[Service]*supervisedProcess
+}
+
+type supervisedProcess struct {
+	service Service
+	spec    *ProcessSpec
+	socket  string
+	pidPath string
+	logPath string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newSupervisor(socketDir string, logDir string) *Supervisor {
+	return &Supervisor{
+		socketDir: socketDir,
+		logDir:    logDir,
+		processes: map[Service]*supervisedProcess{},
+	}
+}
+
+func (s *Supervisor) socket(service Service) string {
+	return filepath.Join(s.socketDir, string(service)+".sock")
+}
+
+func (s *Supervisor) pidPath(service Service) string {
+	return filepath.Join(s.socketDir, string(service)+".pid")
+}
+
+func (s *Supervisor) logPath(service Service) string {
+	return filepath.Join(s.logDir, string(service)+".log")
+}
+
+// killLeftovers stops the processes a previous agent left running. They are in process groups of their own and
+// outlive the agent, and a second instance of a manager would fight the first one over its socket.
+func (s *Supervisor) killLeftovers() {
+	pidFiles, err := filepath.Glob(filepath.Join(s.socketDir, "*.pid"))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, pidFile := range pidFiles {
+		if pid, err := readPidFile(pidFile); err != nil {
+			log.Printf("failed to read %s: %v\n", pidFile, err)
+		} else if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+			// A manager leads its process group, a pid reused by an unrelated process most likely doesn't
+			log.Printf("stopping process %d left running by a previous agent\n", pid)
+			stopProcessGroup("process "+strconv.Itoa(pid), pid, func() bool { return syscall.Kill(-pid, 0) != nil })
+		}
+		os.Remove(pidFile)
+	}
+}
+
+func (s *Supervisor) Start(ctx context.Context, service Service, entry *CatalogEntry) error {
+	if entry.Process == nil {
+		return fmt.Errorf("service %s has no process in the catalog", string(service))
+	}
+	if entry.Quotas.Storage != "" || entry.Quotas.Egress != "" {
+		log.Printf("warning: quotas of %s are not enforced on host processes\n", string(service))
+	}
+	if len(entry.Volumes) > 0 {
+		log.Printf("warning: volumes of %s are not mounted into host processes\n", string(service))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.processes[service]; found {
+		return nil
+	}
+	for _, dir := range []string{s.socketDir, s.logDir} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+	}
+
+	process := &supervisedProcess{
+		service: service,
+		spec:    entry.Process,
+		socket:  s.socket(service),
+		pidPath: s.pidPath(service),
+		logPath: s.logPath(service),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.processes[service] = process
+	go process.supervise()
+	return nil
+}
+
+func (s *Supervisor) Stop(ctx context.Context, service Service) error {
+	s.mu.Lock()
+	process, found := s.processes[service]
+	delete(s.processes, service)
+	s.mu.Unlock()
+
+	if !found {
+		return nil
+	}
+	close(process.stop)
+	select {
+	case <-process.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Running lists the supervised services, including those whose process exited and was left stopped by its restart
+// policy. Listing them as not running would have the agent start them again on its next sync.
+func (s *Supervisor) Running(ctx context.Context) (Services, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running := Services{}
+	for service := range s.processes {
+		running = append(running, service)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i] < running[j] })
+	return running, nil
+}
+
+func (s *Supervisor) Target(ctx context.Context, service Service) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	process, found := s.processes[service]
+	if !found {
+		return "", fmt.Errorf("service %s is not running", string(service))
+	}
+	if !process.running() {
+		return "", fmt.Errorf("process of %s exited and its restart policy leaves it stopped", string(service))
+	}
+	return "unix://" + process.socket, nil
+}
+
+func (s *Supervisor) Drift(ctx context.Context, service Service, entry *CatalogEntry) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A process left stopped by its restart policy is still compared, so a changed definition starts it again
+	process, found := s.processes[service]
+	if !found {
+		return nil, fmt.Errorf("service %s is not running", string(service))
+	}
+	drift := []string{}
+	if entry.Process == nil || !reflect.DeepEqual(process.spec.Command, entry.Process.Command) {
+		drift = append(drift, "command")
+	}
+	if entry.Process == nil || !reflect.DeepEqual(process.spec.Env, entry.Process.Env) {
+		drift = append(drift, "env")
+	}
+	if entry.Process == nil || process.spec.Restart != entry.Process.Restart {
+		drift = append(drift, "restart")
+	}
+	return drift, nil
+}
+
+// Logs opens the captured output of the manager of service, which has to be supervised or in the catalog
+func (s *Supervisor) Logs(service Service) (io.ReadCloser, error) {
+	// service comes from the caller, it must not lead out of the log directory
+	if service == "" || strings.ContainsAny(string(service), `/\`) {
+		return nil, fmt.Errorf("invalid service %q", string(service))
+	}
+	s.mu.Lock()
+	_, supervised := s.processes[service]
+	s.mu.Unlock()
+	if !supervised {
+		catalog, err := loadCatalog(CatalogPath)
+		if err != nil {
+			return nil, err
+		}
+		if _, found := catalog[service]; !found {
+			return nil, fmt.Errorf("unknown service %q", string(service))
+		}
+	}
+	return os.Open(s.logPath(service))
+}
+
+// running reports whether the process is still supervised, it may be waiting to be restarted. It isn't once the
+// process exited for good, as its restart policy says.
+func (process *supervisedProcess) running() bool {
+	select {
+	case <-process.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// env is the environment of the process: the little of the agent's own that hostEnv passes on, what the manager
+// needs and the catalog's env
+func (process *supervisedProcess) env() []string {
+	env := append(hostEnv(), "CONFIG_DIR="+ConfigDir, "INSTANCE_ID="+InstanceID, "MANAGER_SOCKET="+process.socket)
+	keys := []string{}
+	for key := range process.spec.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+process.spec.Env[key])
+	}
+	return env
+}
+
+// supervise runs the process until it is stopped, restarting it as its restart policy says with an increasing delay
+func (process *supervisedProcess) supervise() {
+	defer close(process.done)
+
+	delay := processRestartDelay
+	for {
+		started := time.Now()
+		stopped, err := process.run()
+		if stopped {
+			return
+		}
+		if err != nil {
+			log.Printf("process of %s exited: %v\n", string(process.service), err)
+		} else {
+			log.Printf("process of %s exited\n", string(process.service))
+		}
+
+		switch process.spec.Restart {
+		case RestartNever:
+			return
+		case RestartOnFailure:
+			if err == nil {
+				return
+			}
+		}
+
+		if time.Since(started) > processHealthyAfter {
+			delay = processRestartDelay
+		}
+		select {
+		case <-process.stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > processRestartMaxDelay {
+			delay = processRestartMaxDelay
+		}
+	}
+}
+
+// run runs the process once, returning whether it was stopped rather than exiting on its own
+func (process *supervisedProcess) run() (bool, error) {
+	logFile, err := openProcessLog(process.logPath)
+	if err != nil {
+		return false, err
+	}
+	defer logFile.Close()
+
+	// A socket left behind by a process that crashed would keep the new one from listening
+	if err := os.Remove(process.socket); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	defer os.Remove(process.socket)
+
+	cmd := exec.Command(process.spec.Command[0], process.spec.Command[1:]...)
+	cmd.Env = process.env()
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// The manager gets a process group of its own, so stopping it also stops whatever it started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	// The pid file lets the next agent stop the process if this one dies without stopping it
+	if err := ioutil.WriteFile(process.pidPath, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0640); err != nil {
+		log.Printf("failed to write pid file of %s: %v\n", string(process.service), err)
+	}
+	defer os.Remove(process.pidPath)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		return false, err
+	case <-process.stop:
+	}
+
+	stopProcessGroup("process of "+string(process.service), cmd.Process.Pid, func() bool {
+		select {
+		case <-exited:
+			return true
+		default:
+			return false
+		}
+	})
+	return true, nil
+}
+
+// stopProcessGroup terminates the process group led by pid and waits for exited to report it gone, killing the group
+// if it takes longer than processStopTimeout. name is how the process is logged.
+func stopProcessGroup(name string, pid int, exited func() bool) {
+	syscall.Kill(-pid, syscall.SIGTERM)
+	if waitExited(exited, processStopTimeout) {
+		return
+	}
+	log.Printf("%s didn't stop in %s, killing it\n", name, processStopTimeout)
+	syscall.Kill(-pid, syscall.SIGKILL)
+	if !waitExited(exited, processStopTimeout) {
+		log.Printf("%s didn't exit after being killed\n", name)
+	}
+}
+
+func waitExited(exited func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !exited() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func readPidFile(path string) (int, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, err
+	}
+	if pid <= 0 {
+		return 0, fmt.Errorf("invalid pid %d", pid)
+	}
+	return pid, nil
+}
+
+// processLog is the log of a supervised process, moved aside to <log>.1 whenever it grows past processLogMaxSize
+type processLog struct {
+	path string
+	file *os.File
+	size int64
+}
+
+func openProcessLog(path string) (*processLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &processLog{path: path, file: file, size: info.Size()}, nil
+}
+
+func (l *processLog) Write(p []byte) (int, error) {
+	if l.size > 0 && l.size+int64(len(p)) > processLogMaxSize {
+		if err := l.rotate(); err != nil {
+			// Keep writing to the current file, and try again once another processLogMaxSize was written
+			log.Printf("failed to rotate %s: %v\n", l.path, err)
+			l.size = 0
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *processLog) rotate() error {
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	l.size = 0
+	return nil
+}
+
+func (l *processLog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestSupervisor returns a Supervisor keeping its sockets and logs in a temporary directory, cleanup removes it
+func newTestSupervisor(t *testing.T) (*Supervisor, func()) {
+	dir, err := ioutil.TempDir("", "supervisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	supervisor := newSupervisor(filepath.Join(dir, "run"), filepath.Join(dir, "logs"))
+	return supervisor, func() { os.RemoveAll(dir) }
+}
+
+// eventually polls condition until it holds or a few seconds went by
+func eventually(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// exitedForGood reports whether the process of service exited and isn't going to be restarted
+func exitedForGood(supervisor *Supervisor, service Service) bool {
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+
+	process, found := supervisor.processes[service]
+	return found && !process.running()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestProcessSpecValidate(t *testing.T) {
+	if err := (&ProcessSpec{Command: []string{"manager"}, Restart: RestartOnFailure}).validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (&ProcessSpec{}).validate(); err == nil {
+		t.Error("expected a process without a command to be invalid")
+	}
+	if err := (&ProcessSpec{Command: []string{"manager"}, Restart: "sometimes"}).validate(); err == nil {
+		t.Error("expected an unknown restart policy to be invalid")
+	}
+}
+
+func TestSupervisorStartStop(t *testing.T) {
+	supervisor, cleanup := newTestSupervisor(t)
+	defer cleanup()
+	// The agent's secrets aren't passed on to managers
+	defer withEnv("BOOTSTRAP_TOKEN", " and a token")()
+	entry := &CatalogEntry{Process: &ProcessSpec{
+		Command: []string{"sh", "-c", `echo "serving on $MANAGER_SOCKET with $LOG_LEVEL logs$BOOTSTRAP_TOKEN"; exec sleep 60`},
+		Env:     map[string]string{"LOG_LEVEL": "debug"},
+	}}
+
+	if err := supervisor.Start(context.Background(), "lb", entry); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the pid file", func() bool { return fileExists(supervisor.pidPath("lb")) })
+
+	running, _ := supervisor.Running(context.Background())
+	if !reflect.DeepEqual(running, Services{"lb"}) {
+		t.Errorf("expected lb to run, got %v", running)
+	}
+	target, err := supervisor.Target(context.Background(), "lb")
+	if err != nil || target != "unix://"+supervisor.socket("lb") {
+		t.Errorf("unexpected target %q (%v)", target, err)
+	}
+	pid, err := readPidFile(supervisor.pidPath("lb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := supervisor.Stop(context.Background(), "lb"); err != nil {
+		t.Fatal(err)
+	}
+	if running, _ := supervisor.Running(context.Background()); len(running) != 0 {
+		t.Errorf("expected nothing to run, got %v", running)
+	}
+	if syscall.Kill(pid, 0) == nil {
+		t.Errorf("process %d is still running", pid)
+	}
+	if fileExists(supervisor.pidPath("lb")) {
+		t.Error("the pid file was left behind")
+	}
+
+	logs, err := ioutil.ReadFile(supervisor.logPath("lb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "serving on " + supervisor.socket("lb") + " with debug logs\n"; string(logs) != expected {
+		t.Errorf("unexpected logs %q", logs)
+	}
+}
+
+func TestSupervisorRestartPolicies(t *testing.T) {
+	supervisor, cleanup := newTestSupervisor(t)
+	defer cleanup()
+
+	supervisor.Start(context.Background(), "once", &CatalogEntry{Process: &ProcessSpec{Command: []string{"true"}, Restart: RestartNever}})
+	supervisor.Start(context.Background(), "succeeds", &CatalogEntry{Process: &ProcessSpec{Command: []string{"true"}, Restart: RestartOnFailure}})
+	eventually(t, "the processes to exit for good", func() bool {
+		return exitedForGood(supervisor, "once") && exitedForGood(supervisor, "succeeds")
+	})
+	// They stay listed, or the agent would start them again
+	if running, _ := supervisor.Running(context.Background()); !reflect.DeepEqual(running, Services{"once", "succeeds"}) {
+		t.Errorf("expected the exited processes to still be listed, got %v", running)
+	}
+	if _, err := supervisor.Target(context.Background(), "once"); err == nil {
+		t.Error("expected no target for an exited process")
+	}
+
+	supervisor.Start(context.Background(), "crashes", &CatalogEntry{Process: &ProcessSpec{Command: []string{"sh", "-c", "echo started; exit 1"}, Restart: RestartOnFailure}})
+	defer supervisor.Stop(context.Background(), "crashes")
+	eventually(t, "the process to be restarted", func() bool {
+		logs, _ := ioutil.ReadFile(supervisor.logPath("crashes"))
+		return strings.Count(string(logs), "started") >= 2
+	})
+	if exitedForGood(supervisor, "crashes") {
+		t.Error("expected the crashing process to still be supervised")
+	}
+}
+
+func TestSupervisorKillLeftovers(t *testing.T) {
+	supervisor, cleanup := newTestSupervisor(t)
+	defer cleanup()
+	if err := os.MkdirAll(supervisor.socketDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	// A manager started by a previous agent, in a process group of its own
+	leftover := exec.Command("sleep", "60")
+	leftover.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := leftover.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- leftover.Wait() }()
+	ioutil.WriteFile(supervisor.pidPath("lb"), []byte(strconv.Itoa(leftover.Process.Pid)+"\n"), 0640)
+	// A pid file of a process that's long gone
+	ioutil.WriteFile(supervisor.pidPath("dns"), []byte("999999999\n"), 0640)
+
+	supervisor.killLeftovers()
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		leftover.Process.Kill()
+		t.Fatal("the leftover process was not stopped")
+	}
+	for _, service := range []Service{"lb", "dns"} {
+		if fileExists(supervisor.pidPath(service)) {
+			t.Errorf("the pid file of %s was left behind", service)
+		}
+	}
+}
+
+func TestSupervisorLogs(t *testing.T) {
+	// The agent's catalog is what tells known services apart
+	_, cleanupAgent := newTestAgent(t, testCatalog)
+	defer cleanupAgent()
+	supervisor, cleanup := newTestSupervisor(t)
+	defer cleanup()
+	os.MkdirAll(supervisor.logDir, 0750)
+	ioutil.WriteFile(supervisor.logPath("lb"), []byte("listening\n"), 0640)
+	ioutil.WriteFile(filepath.Join(filepath.Dir(supervisor.logDir), "secret.log"), []byte("secret\n"), 0640)
+
+	logs, err := supervisor.Logs("lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(logs)
+	logs.Close()
+	if string(content) != "listening\n" {
+		t.Errorf("unexpected logs %q", content)
+	}
+
+	for _, service := range []Service{"", "../secret", `..\secret`, "unknown"} {
+		if logs, err := supervisor.Logs(service); err == nil {
+			logs.Close()
+			t.Errorf("expected the logs of %q to be refused", service)
+		}
+	}
+}
+
+func TestSupervisorDrift(t *testing.T) {
+	supervisor, cleanup := newTestSupervisor(t)
+	defer cleanup()
+	spec := &ProcessSpec{Command: []string{"sleep", "60"}, Env: map[string]string{"LOG_LEVEL": "info"}}
+	supervisor.Start(context.Background(), "lb", &CatalogEntry{Process: spec})
+	defer supervisor.Stop(context.Background(), "lb")
+
+	drift, err := supervisor.Drift(context.Background(), "lb", &CatalogEntry{Process: &ProcessSpec{Command: []string{"sleep", "60"}, Env: map[string]string{"LOG_LEVEL": "info"}}})
+	if err != nil || len(drift) != 0 {
+		t.Errorf("expected no drift, got %v (%v)", drift, err)
+	}
+	drift, err = supervisor.Drift(context.Background(), "lb", &CatalogEntry{Process: &ProcessSpec{Command: []string{"sleep", "60"}, Env: map[string]string{"LOG_LEVEL": "debug"}, Restart: RestartNever}})
+	if err != nil || !reflect.DeepEqual(drift, []string{"env", "restart"}) {
+		t.Errorf("expected env and restart to drift, got %v (%v)", drift, err)
+	}
+}
+
+func TestProcessLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "process-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lb.log")
+
+	processLog, err := openProcessLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processLog.Write(make([]byte, processLogMaxSize-10))
+	processLog.Close()
+
+	// The size of an existing log counts towards the limit
+	processLog, err = openProcessLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processLog.Write([]byte("0123456789abcdef"))
+	processLog.Close()
+
+	rotated, err := os.Stat(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Size() != processLogMaxSize-10 {
+		t.Errorf("unexpected size %d of the rotated log", rotated.Size())
+	}
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "0123456789abcdef" {
+		t.Errorf("unexpected current log %q", current)
+	}
+}
+
+func TestSyncRespectsRestartPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync-processes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runs := filepath.Join(dir, "runs")
+	catalog := `
+job:
+  process:
+    command: ["sh", "-c", "echo run >> ` + runs + `"]
+    restart: never
+`
+	agent, cleanup := newTestAgent(t, catalog)
+	defer cleanup()
+	supervisor, cleanupSupervisor := newTestSupervisor(t)
+	defer cleanupSupervisor()
+	agent.Agent.provider = supervisor
+	agent.setConfig("job", "enabled", "true")
+
+	for i := 0; i < 3; i++ {
+		agent.syncStore(t)
+		eventually(t, "the process to exit", func() bool { return exitedForGood(supervisor, "job") })
+	}
+
+	content, err := ioutil.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(string(content), "run"); count != 1 {
+		t.Errorf("expected the process to run once, it ran %d times", count)
+	}
+
+	// A changed definition is a new process, which gets to run again
+	ioutil.WriteFile(CatalogPath, []byte(strings.Replace(catalog, "echo run", "echo run again", 1)), 0644)
+	agent.syncStore(t)
+	eventually(t, "the new process to run", func() bool {
+		content, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(content), "run") == 2
+	})
+}
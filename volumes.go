@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	units "github.com/docker/go-units"
+	pb "github.com/opencopilot/agent/agent"
+)
+
+const (
+	volumeServiceLabel = "com.opencopilot.volume-service"
+	volumeNameLabel    = "com.opencopilot.volume"
+	// volumeHookPath is where container backup hooks find the volume
+	volumeHookPath = "/volume"
+)
+
+// volumeNamePattern matches the names docker accepts for volumes
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Volume is a named docker volume owned by the agent and mounted into a service's manager. It outlives the manager's
+// containers, so state survives recreation, and is never removed by the agent.
+type Volume struct {
+	Name string `yaml:"name"`
+	// Path is where the volume is mounted in the manager container
+	Path string `yaml:"path"`
+	// Size caps the volume, e.g. "1G", it needs the local volume driver on xfs with pquota
+	Size string `yaml:"size"`
+	// Backup hooks are run against the volume every time its manager is stopped, before the post-stop hooks
+	Backup []*Hook `yaml:"backup"`
+}
+
+func (volume *Volume) validate() error {
+	if !volumeNamePattern.MatchString(volume.Name) {
+		return fmt.Errorf("invalid volume name %q", volume.Name)
+	}
+	if !path.IsAbs(volume.Path) {
+		return fmt.Errorf("volume %s needs an absolute path", volume.Name)
+	}
+	if volume.Size != "" {
+		if _, err := units.RAMInBytes(volume.Size); err != nil {
+			return fmt.Errorf("invalid size %q of volume %s: %v", volume.Size, volume.Name, err)
+		}
+	}
+	for _, hook := range volume.Backup {
+		if err := hook.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dockerVolumeName is the name of the docker volume backing volume of service, unique per service
+func dockerVolumeName(service Service, volume *Volume) string {
+	return "opencopilot-" + string(service) + "-" + volume.Name
+}
+
+// volumeBinds mounts the volumes of a service at their path
+func (entry *CatalogEntry) volumeBinds(service Service) []string {
+	binds := []string{}
+	for _, volume := range entry.Volumes {
+		binds = append(binds, dockerVolumeName(service, volume)+":"+volume.Path)
+	}
+	return binds
+}
+
+// ensureVolumes creates the volumes of service that don't exist yet, docker hands back those that do. A daemon that
+// can't enforce a volume's size refuses to create it, so the manager isn't started with an unbounded volume.
+func (p *dockerProvider) ensureVolumes(ctx context.Context, service Service, entry *CatalogEntry) error {
+	for _, volume := range entry.Volumes {
+		options := volumetypes.VolumeCreateBody{
+			Name: dockerVolumeName(service, volume),
+			Labels: map[string]string{
+				"com.opencopilot.managed": "",
+				volumeServiceLabel:        string(service),
+				volumeNameLabel:           volume.Name,
+			},
+		}
+		if volume.Size != "" {
+			options.DriverOpts = map[string]string{"size": volume.Size}
+		}
+		_, err := p.runtime.VolumeCreate(ctx, options)
+		if err != nil {
+			return fmt.Errorf("failed to create volume %s of %s: %v", volume.Name, string(service), err)
+		}
+	}
+	return nil
+}
+
+// backupVolumes runs the backup hooks of every volume of a stopped service
+func (agent *Agent) backupVolumes(service Service, entry *CatalogEntry) error {
+	if agent.runtime == nil {
+		return nil
+	}
+	for _, volume := range entry.Volumes {
+		if len(volume.Backup) == 0 {
+			continue
+		}
+		info, err := agent.runtime.VolumeInspect(context.Background(), dockerVolumeName(service, volume))
+		if err != nil {
+			return err
+		}
+		if err := agent.runHooks(service, "backup", volume.Backup, &info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listVolumes lists the volumes the agent created, and whether the manager using each is running
+func (agent *Agent) listVolumes(ctx context.Context) (*pb.VolumeList, error) {
+	if agent.runtime == nil {
+		return nil, errNoRuntime
+	}
+	volumes, err := agent.runtime.VolumeList(ctx, filters.NewArgs(filters.Arg("label", volumeServiceLabel)))
+	if err != nil {
+		return nil, err
+	}
+	localServices, err := agent.getLocalServices()
+	if err != nil {
+		return nil, err
+	}
+
+	list := &pb.VolumeList{Volumes: []*pb.Volume{}}
+	for _, volume := range volumes.Volumes {
+		service := volume.Labels[volumeServiceLabel]
+		list.Volumes = append(list.Volumes, &pb.Volume{
+			Name:       volume.Labels[volumeNameLabel],
+			Service:    service,
+			DockerName: volume.Name,
+			Mountpoint: volume.Mountpoint,
+			CreatedAt:  volume.CreatedAt,
+			InUse:      localServices.contains(Service(service)),
+		})
+	}
+	return list, nil
+}
+
+// volumeHookEnv tells a backup hook which volume to back up and where to find it
+func volumeHookEnv(volume *dockerTypes.Volume, volumePath string) []string {
+	return []string{"VOLUME=" + volume.Name, "VOLUME_PATH=" + volumePath}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestVolumeValidate(t *testing.T) {
+	if err := (&Volume{Name: "state", Path: "/var/lib/state"}).validate(); err != nil {
+		t.Error(err)
+	}
+	invalid := []*Volume{
+		{Name: "", Path: "/var/lib/state"},
+		{Name: "../state", Path: "/var/lib/state"},
+		{Name: "state", Path: "var/lib/state"},
+		{Name: "state", Path: "/var/lib/state", Backup: []*Hook{{}}},
+	}
+	for _, volume := range invalid {
+		if err := volume.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", volume)
+		}
+	}
+
+	duplicate := `lb: {image: "manager", volumes: [{name: "state", path: "/a"}, {name: "state", path: "/b"}]}`
+	if err := yaml.Unmarshal([]byte(duplicate), &Catalog{}); err == nil {
+		t.Error("expected duplicate volume names to be refused")
+	}
+}
+
+func TestEnsureVolumes(t *testing.T) {
+	runtime := NewFakeContainerRuntime()
+	provider := &dockerProvider{runtime: runtime}
+	entry := &CatalogEntry{Volumes: []*Volume{{Name: "state", Path: "/var/lib/haproxy"}}}
+
+	if err := provider.ensureVolumes(context.Background(), "lb", entry); err != nil {
+		t.Fatal(err)
+	}
+	// Volumes are kept across starts, an existing one is reused
+	runtime.Volumes["opencopilot-lb-state"].CreatedAt = "yesterday"
+	if err := provider.ensureVolumes(context.Background(), "lb", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	volume, found := runtime.Volumes["opencopilot-lb-state"]
+	if !found || len(runtime.Volumes) != 1 {
+		t.Fatalf("unexpected volumes %v", runtime.Volumes)
+	}
+	if volume.CreatedAt != "yesterday" {
+		t.Error("the volume was recreated")
+	}
+	expected := map[string]string{"com.opencopilot.managed": "", volumeServiceLabel: "lb", volumeNameLabel: "state"}
+	if !reflect.DeepEqual(volume.Labels, expected) {
+		t.Errorf("unexpected labels %v", volume.Labels)
+	}
+	if binds := entry.volumeBinds("lb"); !reflect.DeepEqual(binds, []string{"opencopilot-lb-state:/var/lib/haproxy"}) {
+		t.Errorf("unexpected binds %v", binds)
+	}
+}
+
+func TestVolumesSurviveRecreation(t *testing.T) {
+	runtime := NewFakeContainerRuntime()
+	provider := &dockerProvider{runtime: runtime}
+	entry := &CatalogEntry{Image: "manager", Volumes: []*Volume{{Name: "state", Path: "/var/lib/haproxy"}}}
+
+	if err := provider.Start(context.Background(), "lb", entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Stop(context.Background(), "lb"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := runtime.Volumes["opencopilot-lb-state"]; !found {
+		t.Error("the volume was removed along with its manager")
+	}
+}
+
+func TestBackupVolumes(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+	runtime := NewFakeContainerRuntime()
+	agent.runtime = runtime
+	backups := filepath.Join(ConfigDir, "backups")
+	os.MkdirAll(backups, 0750)
+
+	entry := &CatalogEntry{Volumes: []*Volume{
+		{Name: "state", Path: "/var/lib/haproxy", Backup: []*Hook{{Command: []string{"sh", "-c", `echo "$VOLUME_PATH" > ` + backups + `/$VOLUME`}}}},
+		{Name: "cache", Path: "/var/cache/haproxy"},
+	}}
+	if err := (&dockerProvider{runtime: runtime}).ensureVolumes(context.Background(), "lb", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := agent.backupVolumes("lb", entry); err != nil {
+		t.Fatal(err)
+	}
+	backedUp, err := ioutil.ReadFile(filepath.Join(backups, "opencopilot-lb-state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backedUp) != runtime.Volumes["opencopilot-lb-state"].Mountpoint+"\n" {
+		t.Errorf("the backup hook got %q as the volume path", backedUp)
+	}
+	if _, err := os.Stat(filepath.Join(backups, "opencopilot-lb-cache")); !os.IsNotExist(err) {
+		t.Error("a volume without backup hooks was backed up")
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	agent, cleanup := newTestAgent(t, testCatalog)
+	defer cleanup()
+
+	if _, err := agent.listVolumes(context.Background()); err != errNoRuntime {
+		t.Errorf("expected errNoRuntime without docker, got %v", err)
+	}
+
+	runtime := NewFakeContainerRuntime()
+	agent.runtime = runtime
+	provider := &dockerProvider{runtime: runtime}
+	provider.ensureVolumes(context.Background(), "lb", &CatalogEntry{Volumes: []*Volume{{Name: "state", Path: "/var/lib/haproxy"}}})
+	provider.ensureVolumes(context.Background(), "dns", &CatalogEntry{Volumes: []*Volume{{Name: "zones", Path: "/var/lib/zones"}}})
+	agent.ensureServices(Services{"lb"})
+
+	list, err := agent.listVolumes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inUse := map[string]bool{}
+	for _, volume := range list.Volumes {
+		inUse[volume.Service+"/"+volume.Name] = volume.InUse
+	}
+	if !reflect.DeepEqual(inUse, map[string]bool{"lb/state": true, "dns/zones": false}) {
+		t.Errorf("unexpected volumes %v", inUse)
+	}
+}